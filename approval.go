@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var approvalFieldKeyRegexp = regexp.MustCompile("^[A-Za-z0-9_-]+$")
+
+// Approval configures the step that waits for someone to approve each
+// deploy to a cautious environment before it starts.
+type Approval struct {
+	// Type is the type of Buildkite step to use, either "block" (the
+	// default) or "input".
+	Type string `yaml:"type"`
+
+	// Prompt is shown when approving, and is interpolated like a step.
+	Prompt string `yaml:"prompt"`
+
+	// AllowedTeams, if set, restricts who can approve deploys to the
+	// members of the given Buildkite teams.
+	AllowedTeams []string `yaml:"allowed_teams"`
+
+	// Fields are Buildkite text or select fields to fill in when
+	// approving. Their values are stored in the build metadata, under a
+	// key specific to the environment.
+	Fields []map[interface{}]interface{} `yaml:"fields"`
+}
+
+// validate checks that the approval configuration is usable.
+func (a *Approval) validate() error {
+	if a.Type != "" && a.Type != "block" && a.Type != "input" {
+		return fmt.Errorf("type must be block or input, not %q", a.Type)
+	}
+	for i, field := range a.Fields {
+		key, ok := field["key"].(string)
+		if !ok || key == "" {
+			return fmt.Errorf("field %d must have a key", i)
+		}
+		if !approvalFieldKeyRegexp.MatchString(key) {
+			return fmt.Errorf(
+				"field key %q may only contain letters, numbers, dashes and underscores", key,
+			)
+		}
+	}
+	return nil
+}
+
+// requiresApproval returns true if deploys to the given environment must
+// be approved: by default, if the pipeline configures approvals and the
+// environment is cautious.
+func (p *Pipeline) requiresApproval(env *Environment) bool {
+	if p.Approval == nil {
+		return false
+	}
+	if env.RequireApproval != nil {
+		return *env.RequireApproval
+	}
+	return env.Cautious
+}
+
+// approvalMetadataKey returns the build metadata key that an approval
+// field's value is stored in for the given environment.
+func approvalMetadataKey(environmentName, fieldKey string) string {
+	return fmt.Sprintf(
+		"jobsworth-approval/%s/%s",
+		stepKeyUnsafeRegexp.ReplaceAllString(environmentName, "_"), fieldKey,
+	)
+}
+
+// step returns the step that waits for approval of the deploy to the given
+// environment.
+func (a *Approval) step(environmentName string) Step {
+	stepType := a.Type
+	if stepType == "" {
+		stepType = "block"
+	}
+	label := fmt.Sprintf("Approve deploy to %s", environmentName)
+	step := Step{
+		stepType: label,
+		"name":   label,
+	}
+	if a.Prompt != "" {
+		step["prompt"] = a.Prompt
+	}
+	if len(a.AllowedTeams) > 0 {
+		teams := make([]interface{}, len(a.AllowedTeams))
+		for i, team := range a.AllowedTeams {
+			teams[i] = team
+		}
+		step["allowed_teams"] = teams
+	}
+	if len(a.Fields) > 0 {
+		fields := make([]interface{}, len(a.Fields))
+		for i, field := range a.Fields {
+			stepField := make(map[interface{}]interface{}, len(field))
+			for k, v := range field {
+				stepField[k] = v
+			}
+			stepField["key"] = approvalMetadataKey(environmentName, field["key"].(string))
+			fields[i] = stepField
+		}
+		step["fields"] = fields
+	}
+	return step
+}
+
+// fieldEnv returns environment variables for the steps of the given
+// environment, each named after an approval field and holding the build
+// metadata key where that field's value can be found, like
+// JOBSWORTH_APPROVAL_REASON=jobsworth-approval/PROD/reason.
+func (a *Approval) fieldEnv(environmentName string) map[string]string {
+	env := make(map[string]string, len(a.Fields))
+	for _, field := range a.Fields {
+		key := field["key"].(string)
+		name := "JOBSWORTH_APPROVAL_" + strings.ToUpper(strings.Replace(key, "-", "_", -1))
+		env[name] = approvalMetadataKey(environmentName, key)
+	}
+	return env
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/go-test/deep"
+)
+
+func TestApprovalValidate(t *testing.T) {
+	tests := []struct {
+		approval Approval
+		valid    bool
+	}{
+		{Approval{}, true},
+		{Approval{Type: "input"}, true},
+		{Approval{Type: "wait"}, false},
+		{Approval{Fields: []map[interface{}]interface{}{{"key": "reason", "text": "Why?"}}}, true},
+		{Approval{Fields: []map[interface{}]interface{}{{"text": "Why?"}}}, false},
+		{Approval{Fields: []map[interface{}]interface{}{{"key": "the reason"}}}, false},
+	}
+	for i, test := range tests {
+		err := test.approval.validate()
+		if (err == nil) != test.valid {
+			t.Errorf("%d: validate returned %v", i, err)
+		}
+	}
+}
+
+func TestApprovalFieldEnv(t *testing.T) {
+	approval := &Approval{
+		Fields: []map[interface{}]interface{}{
+			{"key": "reason"},
+			{"key": "change-ticket"},
+		},
+	}
+	expected := map[string]string{
+		"JOBSWORTH_APPROVAL_REASON":        "jobsworth-approval/prod_eu/reason",
+		"JOBSWORTH_APPROVAL_CHANGE_TICKET": "jobsworth-approval/prod_eu/change-ticket",
+	}
+	if diff := deep.Equal(expected, approval.fieldEnv("prod.eu")); diff != nil {
+		t.Error(diff)
+	}
+}
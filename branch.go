@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// BranchRule selects which phases and environments run for builds of
+// branches whose name matches its pattern.
+type BranchRule struct {
+	// Pattern is either a glob, where * matches any sequence of
+	// characters (including slashes) and ? matches any single character,
+	// or a regular expression enclosed in slashes, like /^release-\d+$/.
+	Pattern string `yaml:"pattern"`
+
+	// Phases lists the phases to run, or all phases if nil. Listing a
+	// built-in phase includes the custom phases positioned against it.
+	Phases []string `yaml:"phases"`
+
+	// Environments lists the environments to deploy to, or all
+	// environments if nil.
+	Environments []string `yaml:"environments"`
+
+	// source describes rules that didn't come from the branches list.
+	source string
+}
+
+// defaultBranchRules are used for pipelines that don't declare any
+// branches: master runs everything, and all other branches only run the
+// smoke tests.
+var defaultBranchRules = []*BranchRule{
+	{Pattern: "master"},
+	{Pattern: "*", Phases: []string{"smoke_test"}},
+}
+
+// branchRule returns the first of the pipeline's branch rules that matches
+// the given branch name, or nil if none match.
+func (p *Pipeline) branchRule(branchName string) (*BranchRule, error) {
+	rules := p.Branches
+	if len(rules) == 0 {
+		rules = defaultBranchRules
+	}
+	for _, rule := range rules {
+		if rule == nil {
+			continue
+		}
+		matched, err := matchPattern(rule.Pattern, branchName)
+		if err != nil {
+			return nil, fmt.Errorf("branch pattern %q: %s", rule.Pattern, err)
+		}
+		if matched {
+			return rule, nil
+		}
+	}
+	return nil, nil
+}
+
+// RunsPhase returns true if the given phase is selected by the rule.
+func (r *BranchRule) RunsPhase(phase *Phase) bool {
+	if r.Phases == nil {
+		return true
+	}
+	for _, name := range r.Phases {
+		if name == phase.name || name == phase.builtin {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPattern matches a name against either a glob or a regular
+// expression enclosed in slashes.
+func matchPattern(pattern, name string) (bool, error) {
+	var re *regexp.Regexp
+	var err error
+	if len(pattern) >= 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		re, err = regexp.Compile(pattern[1 : len(pattern)-1])
+	} else {
+		re, err = regexp.Compile(globToRegexp(pattern))
+	}
+	if err != nil {
+		return false, err
+	}
+	return re.MatchString(name), nil
+}
+
+func globToRegexp(glob string) string {
+	var buf strings.Builder
+	buf.WriteString("^")
+	for _, c := range glob {
+		switch c {
+		case '*':
+			buf.WriteString(".*")
+		case '?':
+			buf.WriteString(".")
+		default:
+			buf.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	buf.WriteString("$")
+	return buf.String()
+}
+
+// PullRequestRule selects which phases and environments run for pull
+// request builds, in place of the branch rules.
+type PullRequestRule struct {
+	// Phases lists the phases to run, or all phases if nil.
+	Phases []string `yaml:"phases"`
+
+	// Environments lists the declared environments to deploy pull
+	// requests to. Unlike in a branch rule, this defaults to none.
+	Environments []string `yaml:"environments"`
+
+	// PreviewEnvironment, if set, is an additional environment created
+	// for each pull request.
+	PreviewEnvironment *PreviewEnvironment `yaml:"preview_environment"`
+}
+
+// PreviewEnvironment is an ephemeral environment deployed to by pull
+// request builds. Its name is interpolated like a step, so it can be made
+// unique to the pull request with ${pull_request_number}.
+type PreviewEnvironment struct {
+	Name        string `yaml:"name"`
+	Environment `yaml:",inline"`
+}
+
+// TagRule selects which phases and environments run for builds of git
+// tags whose name matches its pattern.
+type TagRule struct {
+	BranchRule `yaml:",inline"`
+
+	// CodeVersionFromTag uses the tag name as the code version, instead
+	// of the usual version derived from the commit.
+	CodeVersionFromTag bool `yaml:"code_version_from_tag"`
+}
+
+// tagRule returns the first of the pipeline's tag rules that matches the
+// given tag name, or nil if none match.
+func (p *Pipeline) tagRule(tagName string) (*TagRule, error) {
+	for _, rule := range p.Tags {
+		if rule == nil {
+			continue
+		}
+		matched, err := matchPattern(rule.Pattern, tagName)
+		if err != nil {
+			return nil, fmt.Errorf("tag pattern %q: %s", rule.Pattern, err)
+		}
+		if matched {
+			return rule, nil
+		}
+	}
+	return nil, nil
+}
+
+// selectRule returns the rule that determines what runs for the build
+// described by the given context, or nil if nothing should run.
+//
+// Pull request builds use the pull_request rule and tag builds use the tag
+// rules, when the pipeline has them, and otherwise builds are selected by
+// their branch.
+func (p *Pipeline) selectRule(context *Context) (*BranchRule, error) {
+	if context.TagName != "" && len(p.Tags) > 0 {
+		tagRule, err := p.tagRule(context.TagName)
+		if err != nil || tagRule == nil {
+			return nil, err
+		}
+		rule := tagRule.BranchRule
+		rule.source = fmt.Sprintf("tag pattern %q", rule.Pattern)
+		return &rule, nil
+	}
+	if context.InPullRequest && p.PullRequest != nil {
+		environments := p.PullRequest.Environments
+		if environments == nil {
+			environments = []string{}
+		}
+		return &BranchRule{
+			Phases:       p.PullRequest.Phases,
+			Environments: environments,
+			source:       "pull_request",
+		}, nil
+	}
+	return p.branchRule(context.BranchName)
+}
+
+// previewEnvironment returns the name and configuration of the pull
+// request's preview environment, or an empty name if there isn't one.
+func (p *Pipeline) previewEnvironment(context *Context) (string, *Environment, error) {
+	if !context.InPullRequest || p.PullRequest == nil || p.PullRequest.PreviewEnvironment == nil {
+		return "", nil, nil
+	}
+	preview := p.PullRequest.PreviewEnvironment
+	if preview.Name == "" {
+		return "", nil, fmt.Errorf("pull_request preview_environment must have a name")
+	}
+	name, err := interpolateString(preview.Name, context, &StepContext{})
+	if err != nil {
+		return "", nil, fmt.Errorf("pull_request preview_environment name: %s", err)
+	}
+	env := preview.Environment
+	env.After = nil
+	return name, &env, nil
+}
+
+// String describes where the rule came from, for error messages.
+func (r *BranchRule) String() string {
+	if r.source != "" {
+		return r.source
+	}
+	return fmt.Sprintf("branch pattern %q", r.Pattern)
+}
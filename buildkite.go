@@ -6,6 +6,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
@@ -16,6 +17,8 @@ import (
 
 type BuildMetadataClient interface {
 	ReadOtherBuildMetadata(number string) (map[string]string, error)
+	FindPreviousGoodDeploy(environmentName, agentEnvironment string, beforeNumber uint64) (string, error)
+	ReadLastDeploy(serviceName, environmentName string) (*DeployRecord, error)
 }
 
 type DryRunBuildMetadataClient struct{}
@@ -27,6 +30,14 @@ func (c *DryRunBuildMetadataClient) ReadOtherBuildMetadata(number string) (map[s
 	return otherMeta, nil
 }
 
+func (c *DryRunBuildMetadataClient) FindPreviousGoodDeploy(environmentName, agentEnvironment string, beforeNumber uint64) (string, error) {
+	return "dry-run-build-number", nil
+}
+
+func (c *DryRunBuildMetadataClient) ReadLastDeploy(serviceName, environmentName string) (*DeployRecord, error) {
+	return nil, nil
+}
+
 type Buildkite struct {
 	// There are two different buildkite APIs in use here.
 	// - The "agent" API is used to interact with the build and job that are
@@ -109,9 +120,116 @@ func (b *Buildkite) ReadOtherBuildMetadata(number string) (map[string]string, er
 	return ret, nil
 }
 
+// maxBuildPages limits how far back through the pipeline's history we
+// search for earlier builds.
+const maxBuildPages = 10
+
+// FindPreviousGoodDeploy finds the build that deployed to an environment
+// before its most recent deploy, and returns its number.
+//
+// The most recent build that deployed to the environment, whether the
+// deploy succeeded or not, is assumed to be what is currently deployed.
+// The result is the next most recent build whose deploy to the environment
+// succeeded, as described by buildDeployOutcome.
+func (b *Buildkite) FindPreviousGoodDeploy(environmentName, agentEnvironment string, beforeNumber uint64) (string, error) {
+	agentRule := "environment=" + agentEnvironment
+	foundCurrent := false
+
+	for page := 1; page <= maxBuildPages; page++ {
+		query := url.Values{}
+		query.Set("page", strconv.Itoa(page))
+		query.Set("per_page", "100")
+		query.Set("state", "finished")
+		builds, err := b.apiGETList([]string{"pipelines", b.pipelineSlug, "builds"}, query)
+		if err != nil {
+			return "", err
+		}
+		if len(builds) == 0 {
+			break
+		}
+
+		for _, rawBuild := range builds {
+			build, ok := rawBuild.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			number, _ := build["number"].(float64)
+			if beforeNumber != 0 && uint64(number) >= beforeNumber {
+				continue
+			}
+			deployed, succeeded := buildDeployOutcome(build, environmentName, agentRule)
+			if !deployed {
+				continue
+			}
+			if !foundCurrent {
+				foundCurrent = true
+				continue
+			}
+			if succeeded {
+				return strconv.FormatUint(uint64(number), 10), nil
+			}
+		}
+	}
+
+	if !foundCurrent {
+		return "", fmt.Errorf("no builds have deployed to %s", agentEnvironment)
+	}
+	return "", fmt.Errorf("no earlier build has successfully deployed to %s", agentEnvironment)
+}
+
+// buildDeployOutcome returns whether a build from the REST API deployed to
+// an environment, and if so whether the deploy succeeded.
+//
+// A deploy recorded in the build's deploy history metadata, by any service,
+// was validated, so it succeeded. Otherwise the build deployed if it started any jobs
+// with the given agent query rule, and the deploy succeeded if all of
+// those jobs passed, whatever happened to the rest of the build.
+func buildDeployOutcome(build map[string]interface{}, environmentName, agentRule string) (bool, bool) {
+	metaData, _ := build["meta_data"].(map[string]interface{})
+	for key := range metaData {
+		if key == deployHistoryMetadataKey("", environmentName) ||
+			(strings.HasPrefix(key, deployHistoryMetadataKey("", "")) && strings.HasSuffix(key, ":"+environmentName)) {
+			return true, true
+		}
+	}
+
+	deployed, succeeded := false, true
+	jobs, _ := build["jobs"].([]interface{})
+	for _, rawJob := range jobs {
+		job, ok := rawJob.(map[string]interface{})
+		if !ok || job["started_at"] == nil {
+			continue
+		}
+		rules, _ := job["agent_query_rules"].([]interface{})
+		for _, rule := range rules {
+			if rule == agentRule {
+				deployed = true
+				if job["state"] != "passed" {
+					succeeded = false
+				}
+				break
+			}
+		}
+	}
+	return deployed, deployed && succeeded
+}
+
 func (b *Buildkite) apiGET(pathParts []string) (map[string]interface{}, error) {
+	ret := map[string]interface{}{}
+	err := b.apiRequest(pathParts, nil, &ret)
+	return ret, err
+}
+
+func (b *Buildkite) apiGETList(pathParts []string, query url.Values) ([]interface{}, error) {
+	ret := []interface{}{}
+	err := b.apiRequest(pathParts, query, &ret)
+	return ret, err
+}
+
+func (b *Buildkite) apiRequest(pathParts []string, query url.Values, out interface{}) error {
 	urlPath := &url.URL{
-		Path: strings.Join(pathParts, "/"),
+		Path:     strings.Join(pathParts, "/"),
+		RawQuery: query.Encode(),
 	}
 	reqURL := b.apiURL.ResolveReference(urlPath)
 
@@ -126,19 +244,18 @@ func (b *Buildkite) apiGET(pathParts []string) (map[string]interface{}, error) {
 
 	res, err := client.Do(req)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	defer res.Body.Close()
 
 	resBodyBytes, err := ioutil.ReadAll(res.Body)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	if res.StatusCode < 200 || res.StatusCode >= 300 {
-		return nil, fmt.Errorf("%s", res.Status)
+		return fmt.Errorf("%s", res.Status)
 	}
 
-	ret := map[string]interface{}{}
-	err = json.Unmarshal(resBodyBytes, &ret)
-	return ret, err
+	return json.Unmarshal(resBodyBytes, out)
 }
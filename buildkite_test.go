@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// testBuildkiteAPI serves the given JSON response bodies for each page of
+// a pipeline's builds.
+func testBuildkiteAPI(t *testing.T, pages ...string) *Buildkite {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/organizations/myorg/pipelines/myrepo/builds" {
+			t.Errorf("unexpected request for %s", r.URL.Path)
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer mytoken" {
+			t.Errorf("missing authorization header")
+		}
+		var page int
+		fmt.Sscanf(r.URL.Query().Get("page"), "%d", &page)
+		if page < 1 || page > len(pages) {
+			fmt.Fprint(w, "[]")
+			return
+		}
+		fmt.Fprint(w, pages[page-1])
+	}))
+	t.Cleanup(server.Close)
+
+	apiURL, _ := url.Parse(server.URL + "/v2/organizations/myorg/")
+	return &Buildkite{
+		apiURL:       apiURL,
+		apiToken:     "mytoken",
+		pipelineSlug: "myrepo",
+	}
+}
+
+func TestFindPreviousGoodDeploy(t *testing.T) {
+	buildkite := testBuildkiteAPI(t, `[
+		{"number": 10, "state": "passed", "jobs": [
+			{"state": "passed", "agent_query_rules": ["queue=deploy", "environment=PROD"], "started_at": "2023-01-01T00:00:00Z"}
+		]},
+		{"number": 9, "state": "failed", "jobs": [
+			{"state": "failed", "agent_query_rules": ["queue=deploy", "environment=PROD"], "started_at": "2023-01-01T00:00:00Z"}
+		]},
+		{"number": 8, "state": "passed", "jobs": [
+			{"state": "passed", "agent_query_rules": ["queue=deploy", "environment=QA"], "started_at": "2023-01-01T00:00:00Z"}
+		]},
+		{"number": 7, "state": "failed", "jobs": [
+			{"state": "failed", "agent_query_rules": ["queue=deploy", "environment=PROD"], "started_at": null}
+		]}
+	]`, `[
+		{"number": 6, "state": "failed", "jobs": [
+			{"state": "failed", "agent_query_rules": ["queue=deploy", "environment=PROD"], "started_at": "2023-01-01T00:00:00Z"}
+		]},
+		{"number": 5, "state": "passed", "jobs": [
+			{"state": "passed", "agent_query_rules": ["queue=deploy", "environment=PROD"], "started_at": "2023-01-01T00:00:00Z"}
+		]}
+	]`)
+
+	tests := []struct {
+		beforeNumber uint64
+		expected     string
+	}{
+		// Build 10 is the current deploy, and 9 failed.
+		{11, "5"},
+		// Build 9 is the current (failed) deploy, so 6 is skipped as failed
+		// and 5 is the previous good one.
+		{10, "5"},
+		{0, "5"},
+	}
+	for _, test := range tests {
+		actual, err := buildkite.FindPreviousGoodDeploy("PROD", "PROD", test.beforeNumber)
+		if err != nil {
+			t.Errorf("before #%d returned err: %s", test.beforeNumber, err)
+		}
+		if actual != test.expected {
+			t.Errorf("before #%d found #%s, not #%s", test.beforeNumber, actual, test.expected)
+		}
+	}
+
+	if _, err := buildkite.FindPreviousGoodDeploy("QA", "QA", 0); err == nil {
+		t.Error("should fail when there is only one deploy to the environment")
+	}
+}
+
+func TestFindPreviousGoodDeployJobState(t *testing.T) {
+	buildkite := testBuildkiteAPI(t, `[
+		{"number": 14, "state": "passed", "jobs": [
+			{"state": "passed", "agent_query_rules": ["queue=deploy", "environment=prod-agents"], "started_at": "2023-01-01T00:00:00Z"}
+		]},
+		{"number": 13, "state": "passed", "jobs": [
+			{"state": "failed", "agent_query_rules": ["queue=deploy", "environment=prod-agents"], "started_at": "2023-01-01T00:00:00Z"}
+		]},
+		{"number": 12, "state": "failed", "jobs": [
+			{"state": "passed", "agent_query_rules": ["queue=deploy", "environment=prod-agents"], "started_at": "2023-01-01T00:00:00Z"},
+			{"state": "failed", "agent_query_rules": ["queue=deploy", "environment=qa"], "started_at": "2023-01-01T00:00:00Z"}
+		]},
+		{"number": 11, "state": "passed", "meta_data": {"jobsworth:deployed:prod": "{}"}, "jobs": []}
+	]`)
+
+	tests := []struct {
+		beforeNumber uint64
+		expected     string
+	}{
+		// Build 13 passed, but its deploy to prod didn't, while build 12
+		// failed elsewhere after deploying to prod.
+		{15, "12"},
+		// Build 11's deploy is only known from its deploy history.
+		{13, "11"},
+	}
+	for _, test := range tests {
+		actual, err := buildkite.FindPreviousGoodDeploy("prod", "prod-agents", test.beforeNumber)
+		if err != nil {
+			t.Errorf("before #%d returned err: %s", test.beforeNumber, err)
+		}
+		if actual != test.expected {
+			t.Errorf("before #%d found #%s, not #%s", test.beforeNumber, actual, test.expected)
+		}
+	}
+}
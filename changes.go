@@ -0,0 +1,274 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/libgit2/git2go/v34"
+)
+
+// changedPathsMatch returns true if any of the files changed by the build
+// match any of the given globs. It also returns true if there are no globs,
+// or if the files that changed aren't known, so that nothing is skipped
+// unless we're sure it isn't affected.
+func (c *Context) changedPathsMatch(patterns []string) bool {
+	if len(patterns) == 0 || !c.ChangedPathsKnown {
+		return true
+	}
+	for _, changedPath := range c.ChangedPaths {
+		for _, pattern := range patterns {
+			if matchPathGlob(pattern, changedPath) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchPathGlob returns true if a slash-separated path matches a glob, or
+// is inside a directory that matches it. Each part of the glob is matched
+// against one part of the path as by path.Match, except for "**", which
+// matches any number of parts.
+func matchPathGlob(pattern, filePath string) bool {
+	patternParts := strings.Split(strings.Trim(pattern, "/"), "/")
+	pathParts := strings.Split(filePath, "/")
+	for i := len(pathParts); i > 0; i-- {
+		if matchPathParts(patternParts, pathParts[:i]) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchPathParts(patternParts, pathParts []string) bool {
+	if len(patternParts) == 0 {
+		return len(pathParts) == 0
+	}
+	if patternParts[0] == "**" {
+		for i := 0; i <= len(pathParts); i++ {
+			if matchPathParts(patternParts[1:], pathParts[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(pathParts) == 0 {
+		return false
+	}
+	if matched, _ := path.Match(patternParts[0], pathParts[0]); !matched {
+		return false
+	}
+	return matchPathParts(patternParts[1:], pathParts[1:])
+}
+
+// validatePathGlobs checks that each glob is well-formed.
+func validatePathGlobs(patterns []string) error {
+	for _, pattern := range patterns {
+		for _, part := range strings.Split(pattern, "/") {
+			if _, err := path.Match(part, ""); err != nil {
+				return fmt.Errorf("invalid path %q: %s", pattern, err)
+			}
+		}
+	}
+	return nil
+}
+
+// usesPaths returns true if any of the pipeline's phases or services are
+// limited to changes to particular files.
+func (p *Pipeline) usesPaths() bool {
+	for _, phase := range p.Phases {
+		if phase != nil && len(phase.Paths) > 0 {
+			return true
+		}
+	}
+	for _, service := range p.Services {
+		if len(service.Paths) > 0 || service.Pipeline.usesPaths() {
+			return true
+		}
+	}
+	return false
+}
+
+// findChangedPaths records in the context the files that the build's
+// commit changes. If they can't be found then nothing is skipped, since
+// the build may be the first or the history may be incomplete.
+func findChangedPaths(context *Context, pipeline *Pipeline, buildkite BuildMetadataClient, out io.Writer) error {
+	head, err := getCurrentGitCommit()
+	if err != nil {
+		fmt.Fprintf(out, "Not skipping anything for unchanged paths: error reading current git commit: %s\n", err)
+		return nil
+	}
+	repo := head.Owner()
+
+	baseIds, err := changeBaseCommits(context, pipeline, buildkite, repo, head)
+	if err != nil {
+		return err
+	}
+	if len(baseIds) == 0 {
+		fmt.Fprintf(out, "Not skipping anything for unchanged paths: no earlier commit to compare with\n")
+		return nil
+	}
+
+	changedPaths, err := gitChangedPaths(repo, head, baseIds)
+	if err != nil {
+		fmt.Fprintf(out, "Not skipping anything for unchanged paths: %s\n", err)
+		return nil
+	}
+	fmt.Fprintf(
+		out, "%d files changed since %s\n",
+		len(changedPaths), strings.Join(baseIds, ", "),
+	)
+	context.ChangedPaths = changedPaths
+	context.ChangedPathsKnown = true
+	return nil
+}
+
+// reportUnchangedPaths explains which phases and services are skipped
+// because none of the files they're limited to have changed.
+func reportUnchangedPaths(context *Context, pipeline *Pipeline, out io.Writer) {
+	for _, name := range pipeline.serviceNames() {
+		if paths := pipeline.Services[name].Paths; !context.changedPathsMatch(paths) {
+			fmt.Fprintf(out, "Skipping service %s: nothing changed in %s\n", name, strings.Join(paths, ", "))
+		}
+	}
+	names := make([]string, 0, len(pipeline.Phases))
+	for name := range pipeline.Phases {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if phase := pipeline.Phases[name]; phase != nil && !context.changedPathsMatch(phase.Paths) {
+			fmt.Fprintf(out, "Skipping phase %s: nothing changed in %s\n", name, strings.Join(phase.Paths, ", "))
+		}
+	}
+}
+
+// changeBaseCommits returns the ids of the commits to find the changes
+// since. When deploy history is recorded and every environment the build
+// deploys to has been deployed before, they are the commits last deployed
+// to each of them. Otherwise the base is the merge base with the branch
+// that a pull request targets, or the default branch, or the previous
+// commit when building that branch itself.
+func changeBaseCommits(context *Context, pipeline *Pipeline, buildkite BuildMetadataClient, repo *git.Repository, head *git.Commit) ([]string, error) {
+	if pipeline.RecordDeployHistory {
+		targets, err := pipeline.deployTargets(context)
+		if err != nil {
+			return nil, fmt.Errorf("Error lowering pipeline: %s", err)
+		}
+		var baseIds []string
+		seen := map[string]bool{}
+		for _, target := range targets {
+			lastDeploy, err := buildkite.ReadLastDeploy(target.service, target.environment)
+			if err != nil {
+				return nil, fmt.Errorf("error reading last deploy to %s: %s", target, err)
+			}
+			if lastDeploy == nil {
+				baseIds = nil
+				break
+			}
+			if !seen[lastDeploy.SourceCommitId] {
+				seen[lastDeploy.SourceCommitId] = true
+				baseIds = append(baseIds, lastDeploy.SourceCommitId)
+			}
+		}
+		if len(baseIds) > 0 {
+			return baseIds, nil
+		}
+	}
+
+	branchName := changeBaseBranch(context, pipeline)
+	var branch *git.Reference
+	var err error
+	for _, refName := range []string{"refs/remotes/origin/" + branchName, "refs/heads/" + branchName} {
+		if branch, err = repo.References.Lookup(refName); err == nil {
+			break
+		}
+	}
+	if branch == nil {
+		return nil, nil
+	}
+
+	mergeBase, err := repo.MergeBase(head.Id(), branch.Target())
+	if err != nil {
+		return nil, nil
+	}
+	if mergeBase.Equal(head.Id()) {
+		if head.ParentCount() == 0 {
+			return nil, nil
+		}
+		mergeBase = head.ParentId(0)
+	}
+	return []string{mergeBase.String()}, nil
+}
+
+// changeBaseBranch returns the name of the branch that the build's changes
+// are found relative to: the branch that a pull request targets, or else
+// the pipeline's default branch, which is master if it isn't configured.
+func changeBaseBranch(context *Context, pipeline *Pipeline) string {
+	if context.InPullRequest && context.PullRequestBaseBranch != "" {
+		return context.PullRequestBaseBranch
+	}
+	if pipeline.DefaultBranch != "" {
+		return pipeline.DefaultBranch
+	}
+	if context.DefaultBranch != "" {
+		return context.DefaultBranch
+	}
+	return "master"
+}
+
+// gitChangedPaths returns the paths of the files that differ between any
+// of the base commits and the head commit, in sorted order. Renamed files
+// are listed under both their old and new paths.
+func gitChangedPaths(repo *git.Repository, head *git.Commit, baseIds []string) ([]string, error) {
+	headTree, err := head.Tree()
+	if err != nil {
+		return nil, err
+	}
+	changed := map[string]bool{}
+	for _, baseId := range baseIds {
+		oid, err := git.NewOid(baseId)
+		if err != nil {
+			return nil, fmt.Errorf("invalid commit id %q: %s", baseId, err)
+		}
+		base, err := repo.LookupCommit(oid)
+		if err != nil {
+			return nil, fmt.Errorf("commit %s: %s", baseId, err)
+		}
+		baseTree, err := base.Tree()
+		if err != nil {
+			return nil, fmt.Errorf("commit %s: %s", baseId, err)
+		}
+		diff, err := repo.DiffTreeToTree(baseTree, headTree, nil)
+		if err != nil {
+			return nil, fmt.Errorf("diff with %s: %s", baseId, err)
+		}
+		numDeltas, err := diff.NumDeltas()
+		if err != nil {
+			diff.Free()
+			return nil, fmt.Errorf("diff with %s: %s", baseId, err)
+		}
+		for i := 0; i < numDeltas; i++ {
+			delta, err := diff.Delta(i)
+			if err != nil {
+				diff.Free()
+				return nil, fmt.Errorf("diff with %s: %s", baseId, err)
+			}
+			changed[delta.OldFile.Path] = true
+			changed[delta.NewFile.Path] = true
+		}
+		diff.Free()
+	}
+
+	paths := make([]string, 0, len(changed))
+	for changedPath := range changed {
+		if changedPath != "" {
+			paths = append(paths, changedPath)
+		}
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"io"
+	"testing"
+
+	"github.com/go-test/deep"
+)
+
+func TestMatchPathGlob(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		matches bool
+	}{
+		{"Makefile", "Makefile", true},
+		{"Makefile", "src/Makefile", false},
+		{"src", "src/main.go", true},
+		{"src/", "src/pkg/main.go", true},
+		{"src", "srcs/main.go", false},
+		{"src/*.go", "src/main.go", true},
+		{"src/*.go", "src/pkg/main.go", false},
+		{"src/**/*.go", "src/main.go", true},
+		{"src/**/*.go", "src/pkg/deep/main.go", true},
+		{"**/*.md", "README.md", true},
+		{"**/*.md", "docs/guide/intro.md", true},
+		{"**/*.md", "docs/guide/intro.txt", false},
+		{"services/*/config", "services/api/config/prod.yml", true},
+	}
+	for _, test := range tests {
+		if matchPathGlob(test.pattern, test.path) != test.matches {
+			t.Errorf("%q matching %q should be %v", test.pattern, test.path, test.matches)
+		}
+	}
+}
+
+func TestChangedPaths(t *testing.T) {
+	commands := func(bkSteps []interface{}) []string {
+		var commands []string
+		for _, bkStep := range bkSteps {
+			if step, ok := bkStep.(Step); ok {
+				command := step["command"].(string)
+				if service := step["env"].(map[interface{}]interface{})["JOBSWORTH_SERVICE"]; service != nil {
+					command = service.(string) + ": " + command
+				}
+				commands = append(commands, command)
+			}
+		}
+		return commands
+	}
+
+	all := []string{
+		"api: make test", "api: make build", "api: make docs",
+		"api: make deploy", "api: make deploy",
+		"web: make test", "web: make build", "web: make docs",
+		"web: make deploy", "web: make deploy",
+	}
+	tests := []struct {
+		changed  []string
+		commands []string
+	}{
+		// Without a git repository to find them in, the changes aren't
+		// known and nothing is skipped.
+		{nil, all},
+		{[]string{"lib/util.go", "src/main.go", "README.md"}, all},
+		{[]string{"services/web/README.md"}, []string{"web: make test", "web: make docs"}},
+		{[]string{"services/api/deploy/prod.yml"}, []string{"api: make test"}},
+		{[]string{"other/file"}, nil},
+	}
+	for _, test := range tests {
+		context := &Context{
+			ConfigFilename:    "testdata/paths.in.yaml",
+			BranchName:        "master",
+			ChangedPaths:      test.changed,
+			ChangedPathsKnown: test.changed != nil,
+		}
+		bkSteps, _, err := generateSteps(context, &DryRunBuildMetadataClient{}, io.Discard)
+		if err != nil {
+			t.Fatal("generateSteps returned err:", err)
+		}
+		if diff := deep.Equal(test.commands, commands(bkSteps)); diff != nil {
+			t.Error(test.changed, diff)
+		}
+	}
+}
+
+func TestChangeBaseBranch(t *testing.T) {
+	tests := []struct {
+		context  Context
+		pipeline Pipeline
+		expected string
+	}{
+		{Context{}, Pipeline{}, "master"},
+		{Context{DefaultBranch: "main"}, Pipeline{}, "main"},
+		{Context{DefaultBranch: "main"}, Pipeline{DefaultBranch: "trunk"}, "trunk"},
+		{
+			Context{DefaultBranch: "main", InPullRequest: true, PullRequestBaseBranch: "release/2"},
+			Pipeline{},
+			"release/2",
+		},
+	}
+	for _, test := range tests {
+		if actual := changeBaseBranch(&test.context, &test.pipeline); actual != test.expected {
+			t.Errorf("%+v: expected %s, got %s", test.context, test.expected, actual)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/hashicorp/hil"
+	hilAST "github.com/hashicorp/hil/ast"
+)
+
+// defaultCodeVersionFormat produces versions like
+// 2017-08-12-160011-eb3733d-000123.
+const defaultCodeVersionFormat = "${commit_time}-${short_sha}-${padded_build_number}"
+
+// FormatCodeVersion expands a code version format template using the
+// details of the commit and build described by the context.
+func (c *Context) FormatCodeVersion(format string) (string, error) {
+	tree, err := hil.Parse(format)
+	if err != nil {
+		return "", err
+	}
+	evalConfig := &hil.EvalConfig{
+		GlobalScope: codeVersionScope(c),
+	}
+	result, _, err := hil.Eval(tree, evalConfig)
+	if err != nil {
+		return "", err
+	}
+	return result.(string), nil
+}
+
+// validateCodeVersionFormat checks that a code version format template is
+// well-formed and refers only to known variables.
+func validateCodeVersionFormat(format string) error {
+	_, err := (&Context{}).FormatCodeVersion(format)
+	return err
+}
+
+func codeVersionScope(c *Context) *hilAST.BasicScope {
+	commitTime := c.SourceGitCommitTime.UTC()
+
+	shortSha := c.SourceGitCommitId
+	if len(shortSha) > 7 {
+		shortSha = shortSha[:7]
+	}
+
+	nearestTagDistance := ""
+	describe := shortSha
+	if c.NearestGitTag != "" {
+		nearestTagDistance = strconv.Itoa(c.NearestGitTagDistance)
+		describe = c.NearestGitTag
+		if c.NearestGitTagDistance > 0 {
+			describe = fmt.Sprintf(
+				"%s-%d-g%s", c.NearestGitTag, c.NearestGitTagDistance, shortSha,
+			)
+		}
+	}
+
+	vars := map[string]string{
+		"commit_time":          commitTime.Format("2006-01-02-150405"),
+		"commit_timestamp":     commitTime.Format("20060102150405"),
+		"commit_date":          commitTime.Format("20060102"),
+		"sha":                  c.SourceGitCommitId,
+		"short_sha":            shortSha,
+		"build_number":         strconv.FormatUint(c.BuildNumber, 10),
+		"padded_build_number":  fmt.Sprintf("%06d", c.BuildNumber),
+		"branch":               c.BranchName,
+		"tag":                  c.TagName,
+		"nearest_tag":          c.NearestGitTag,
+		"nearest_tag_distance": nearestTagDistance,
+		"describe":             describe,
+	}
+
+	scope := &hilAST.BasicScope{
+		VarMap: make(map[string]hilAST.Variable, len(vars)),
+	}
+	for k, v := range vars {
+		scope.VarMap[k] = hilAST.Variable{
+			Value: v,
+			Type:  hilAST.TypeString,
+		}
+	}
+	return scope
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFormatCodeVersion(t *testing.T) {
+	context := &Context{
+		BuildNumber:           123,
+		BranchName:            "main",
+		SourceGitCommitId:     "eb3733d160e74a9c7e442f435eb3bea458e1d19f",
+		SourceGitCommitTime:   time.Date(2017, 8, 12, 16, 0, 11, 0, time.UTC),
+		NearestGitTag:         "v1.2.0",
+		NearestGitTagDistance: 4,
+	}
+	tests := map[string]string{
+		defaultCodeVersionFormat:                              "2017-08-12-160011-eb3733d-000123",
+		"${nearest_tag}-${nearest_tag_distance}+${short_sha}": "v1.2.0-4+eb3733d",
+		"${describe}": "v1.2.0-4-geb3733d",
+		"${branch}.${build_number}.${commit_timestamp}.${sha}": "main.123.20170812160011.eb3733d160e74a9c7e442f435eb3bea458e1d19f",
+	}
+	for format, expected := range tests {
+		actual, err := context.FormatCodeVersion(format)
+		if err != nil {
+			t.Errorf("format %s returned err: %s", format, err)
+		}
+		if actual != expected {
+			t.Errorf("format %s gave %q, not %q", format, actual, expected)
+		}
+	}
+
+	context.NearestGitTagDistance = 0
+	if actual, _ := context.FormatCodeVersion("${describe}"); actual != "v1.2.0" {
+		t.Errorf("describe on a tagged commit gave %q", actual)
+	}
+}
+
+func TestValidateCodeVersionFormat(t *testing.T) {
+	if err := validateCodeVersionFormat("${nearest_tag}+${short_sha}"); err != nil {
+		t.Error("valid format returned err:", err)
+	}
+	err := validateCodeVersionFormat("${short_shaa}")
+	if err == nil {
+		t.Fatal("format with unknown variable should fail validation")
+	}
+	if !strings.Contains(err.Error(), "unknown variable accessed: short_shaa") {
+		t.Error("message should say something about the bad variable", err.Error())
+	}
+	if err := validateCodeVersionFormat("${short_sha"); err == nil {
+		t.Error("malformed format should fail validation")
+	}
+}
@@ -1,31 +1,88 @@
 package main
 
 import (
-	"fmt"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/libgit2/git2go/v34"
 )
 
 type Context struct {
-	BuildNumber                   uint64
-	BuildkitePipelineSlug         string
-	BuildkiteOrganizationSlug     string
-	BuildkiteAgentAccessToken     string
-	BuildkiteAgentEndpointURL     string
-	BuildkiteAPIAccessToken       string
-	BuildkiteJobId                string
-	BuildkiteBuildId              string
-	ConfigFilename                string
-	BranchName                    string
-	BuildMessage                  string
-	RepoURL                       string
-	InPullRequest                 bool
-	BuildEnvironment              string
-	CodeVersion                   string
-	SourceGitCommitId             string
-	ArtifactsFromBuildNumber      string
-	OverrideDeployEnvironmentName string
+	BuildNumber               uint64
+	BuildkitePipelineSlug     string
+	BuildkiteOrganizationSlug string
+	BuildkiteAgentAccessToken string
+	BuildkiteAgentEndpointURL string
+	BuildkiteAPIAccessToken   string
+	BuildkiteJobId            string
+	BuildkiteBuildId          string
+	ConfigFilename            string
+	BranchName                string
+	TagName                   string
+	BuildMessage              string
+	RepoURL                   string
+	InPullRequest             bool
+	PullRequestNumber         string
+	PullRequestBaseBranch     string
+	DefaultBranch             string
+	BuildEnvironment          string
+	CodeVersion               string
+	SourceGitCommitId         string
+	SourceGitCommitTime       time.Time
+	NearestGitTag             string
+	NearestGitTagDistance     int
+	ArtifactsFromBuildNumber  string
+	RollbackEnvironmentName   string
+
+	// OverrideDeployEnvironmentNames are the environments named by the
+	// build message, which are deployed to in turn in place of the
+	// environments in the pipeline file. Unless ForceOverrideEnvironments
+	// is set, each of them must be declared in the pipeline file.
+	OverrideDeployEnvironmentNames []string
+	ForceOverrideEnvironments      bool
+
+	// ServiceName is the name of the service whose steps are being
+	// lowered, if the pipeline has services, with ServicePath its path in
+	// the repository. Codebase overrides the codebase name for it.
+	ServiceName string
+	ServicePath string
+	Codebase    string
+
+	// SkipDeployEnvironments maps the names of environments that should
+	// not be deployed to onto the reason why.
+	SkipDeployEnvironments map[string]string
+	// ServiceSkipDeployEnvironments holds the SkipDeployEnvironments for
+	// each service, by its name.
+	ServiceSkipDeployEnvironments map[string]map[string]string
+
+	// BuildTime is when the build started, which determines whether any
+	// deploy freezes are in effect.
+	BuildTime time.Time
+	// FrozenEnvironments maps the names of environments that are frozen
+	// onto the freeze window responsible.
+	FrozenEnvironments map[string]*FreezeWindow
+	// FreezeOverrideReason is the reason given for deploying to the
+	// override environment despite any freeze.
+	FreezeOverrideReason string
+
+	// ChangedPaths are the files that the build's commit changes, if
+	// ChangedPathsKnown is set. Phases and services limited to other paths
+	// are skipped.
+	ChangedPaths      []string
+	ChangedPathsKnown bool
+	// InGitRepository is set when the commit was read from the git
+	// repository in the current directory, which means the changed paths
+	// can be found from it too.
+	InGitRepository bool
+
+	// CommitTrailers are the trailers at the end of the message of the
+	// commit being built, and BuildMetadata is the metadata the build was
+	// triggered with, read from Buildkite if nil. Both can give
+	// Overrides for the build.
+	CommitTrailers map[string]string
+	BuildMetadata  map[string]string
+	Overrides      BuildOverrides
 }
 
 type StepContext struct {
@@ -35,6 +92,15 @@ type StepContext struct {
 	Cautious        bool
 	// use concurrency and concurrency_group to force only one to run at a time
 	PreventConcurrency bool
+	// Environment is the configuration of the deploy environment, or nil
+	// for steps that don't run in a deploy environment.
+	Environment *Environment
+	// ApprovalFields maps environment variables onto the metadata keys
+	// of the fields filled in to approve the deploy, if it needed approval.
+	ApprovalFields map[string]string
+	// Defaults are merged into each command step before it is
+	// interpolated.
+	Defaults Step
 }
 
 // CodebaseName tries to infer a name for the codebase from the repository
@@ -44,7 +110,12 @@ type StepContext struct {
 // and removing a .git suffix if present.
 //
 // For example, git@github.com:example/foo.git would return "foo".
+//
+// The steps of a service use the service's codebase instead.
 func (c *Context) CodebaseName() string {
+	if c.Codebase != "" {
+		return c.Codebase
+	}
 	repoUrl := c.RepoURL
 
 	slashIndex := strings.LastIndex(repoUrl, "/")
@@ -67,26 +138,119 @@ func (c *Context) DoMessageMagic() {
 	}
 
 	{
+		// "Roll back PROD" rolls back a single environment to whatever
+		// it was running before its most recent deploy.
+		matchParts := rollbackEnvMessageRegexp.FindStringSubmatch(c.BuildMessage)
+		if len(matchParts) == 2 {
+			c.RollbackEnvironmentName = matchParts[1]
+			c.OverrideDeployEnvironmentNames = []string{matchParts[1]}
+			return
+		}
+	}
+
+	{
+		// "Deploy to PROD despite freeze: <reason>" is like "Deploy to
+		// PROD", but lifts any freeze on the environment.
+		matchParts := freezeOverrideMessageRegexp.FindStringSubmatch(c.BuildMessage)
+		if len(matchParts) == 7 {
+			c.ForceOverrideEnvironments = matchParts[1] != ""
+			c.ArtifactsFromBuildNumber = matchParts[3]
+			c.OverrideDeployEnvironmentNames = splitEnvironmentList(matchParts[5])
+			c.FreezeOverrideReason = strings.TrimSpace(matchParts[6])
+			return
+		}
+	}
+
+	{
+		// "Deploy #12 to QA, STAGE and LOADTEST" deploys to each of the
+		// listed environments in turn, and "Force deploy ..." allows
+		// environments that aren't in the pipeline file.
 		matchParts := envOverrideMessageRegexp.FindStringSubmatch(c.BuildMessage)
-		if len(matchParts) == 5 {
-			c.ArtifactsFromBuildNumber = matchParts[2]
-			c.OverrideDeployEnvironmentName = matchParts[4]
+		if len(matchParts) == 6 {
+			c.ForceOverrideEnvironments = matchParts[1] != ""
+			c.ArtifactsFromBuildNumber = matchParts[3]
+			c.OverrideDeployEnvironmentNames = splitEnvironmentList(matchParts[5])
 			return
 		}
 	}
 }
 
+// splitEnvironmentList splits a list of environment names from a build
+// message, dropping any repeated names.
+func splitEnvironmentList(list string) []string {
+	var names []string
+	seen := map[string]bool{}
+	for _, name := range envListSeparatorRegexp.Split(list, -1) {
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
 func (c *Context) SetGitCommit(commit *git.Commit) {
 	commitId := commit.Id()
-	commitTime := commit.Committer().When.UTC()
-
-	c.CodeVersion = fmt.Sprintf(
-		"%s-%s-%06d",
-		commitTime.Format("2006-01-02-150405"),
-		commitId.String()[:7],
-		c.BuildNumber,
-	)
+
 	c.SourceGitCommitId = commitId.String()
+	c.SourceGitCommitTime = commit.Committer().When.UTC()
+	c.NearestGitTag, c.NearestGitTagDistance = describeGitCommit(commit)
+	c.CommitTrailers = commitTrailers(commit.Message())
+	c.InGitRepository = true
+
+	// The default format refers only to known variables, so this can't fail.
+	c.CodeVersion, _ = c.FormatCodeVersion(defaultCodeVersionFormat)
+}
+
+// describeGitCommit finds the nearest tag reachable from the given commit
+// and the number of commits since it, like "git describe --tags". If no
+// tag is reachable then the tag name is empty.
+func describeGitCommit(commit *git.Commit) (string, int) {
+	opts, err := git.DefaultDescribeOptions()
+	if err != nil {
+		return "", 0
+	}
+	opts.Strategy = git.DescribeTags
+	result, err := commit.Describe(&opts)
+	if err != nil {
+		return "", 0
+	}
+	defer result.Free()
+
+	formatOpts, err := git.DefaultDescribeFormatOptions()
+	if err != nil {
+		return "", 0
+	}
+	formatOpts.AlwaysUseLongFormat = true
+	described, err := result.Format(&formatOpts)
+	if err != nil {
+		return "", 0
+	}
+
+	// The long format is always <tag>-<distance>-g<abbreviated id>, and
+	// the tag itself may contain hyphens.
+	shaIndex := strings.LastIndex(described, "-g")
+	if shaIndex == -1 {
+		return "", 0
+	}
+	described = described[:shaIndex]
+	distanceIndex := strings.LastIndex(described, "-")
+	if distanceIndex == -1 {
+		return "", 0
+	}
+	distance, err := strconv.Atoi(described[distanceIndex+1:])
+	if err != nil {
+		return "", 0
+	}
+	return described[:distanceIndex], distance
+}
+
+func (c *Context) PullRequestStr() string {
+	if c.InPullRequest {
+		return "1"
+	} else {
+		return "0"
+	}
 }
 
 func (c *StepContext) CautiousStr() string {
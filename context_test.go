@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/go-test/deep"
+)
+
+func TestDoMessageMagic(t *testing.T) {
+	tests := []struct {
+		message                  string
+		artifactsFromBuildNumber string
+		rollbackEnvironmentName  string
+		overrideEnvironmentNames []string
+		force                    bool
+	}{
+		{"Fix the spline reticulator", "", "", nil, false},
+		{"Roll back to #12 to fix splines", "12", "", nil, false},
+		{"rollback 12", "12", "", nil, false},
+		{"Roll back PROD because of splines", "", "PROD", []string{"PROD"}, false},
+		{"Roll back to PROD", "", "PROD", []string{"PROD"}, false},
+		{"Deploy to FOO", "", "", []string{"FOO"}, false},
+		{"Deploy #12 to FOO", "12", "", []string{"FOO"}, false},
+		{"Deploy to PROD despite freeze: fixing the outage", "", "", []string{"PROD"}, false},
+		{"Deploy #12 to QA, STAGE and LOADTEST", "12", "", []string{"QA", "STAGE", "LOADTEST"}, false},
+		{"Deploy to QA and STAGE to check the fix", "", "", []string{"QA", "STAGE"}, false},
+		{"Deploy to QA,STAGE, and QA", "", "", []string{"QA", "STAGE"}, false},
+		{"Force deploy #12 to QA and TEMP", "12", "", []string{"QA", "TEMP"}, true},
+		{"force deploy to QA and PROD despite freeze: fixing the outage", "", "", []string{"QA", "PROD"}, true},
+	}
+	for _, test := range tests {
+		context := &Context{BuildMessage: test.message}
+		context.DoMessageMagic()
+		if context.ArtifactsFromBuildNumber != test.artifactsFromBuildNumber {
+			t.Errorf("%q: ArtifactsFromBuildNumber is %q", test.message, context.ArtifactsFromBuildNumber)
+		}
+		if context.RollbackEnvironmentName != test.rollbackEnvironmentName {
+			t.Errorf("%q: RollbackEnvironmentName is %q", test.message, context.RollbackEnvironmentName)
+		}
+		if diff := deep.Equal(test.overrideEnvironmentNames, context.OverrideDeployEnvironmentNames); diff != nil {
+			t.Errorf("%q: OverrideDeployEnvironmentNames: %s", test.message, diff)
+		}
+		if context.ForceOverrideEnvironments != test.force {
+			t.Errorf("%q: ForceOverrideEnvironments is %v", test.message, context.ForceOverrideEnvironments)
+		}
+	}
+}
+
+func TestDoMessageMagicFreezeOverride(t *testing.T) {
+	context := &Context{BuildMessage: "Deploy #12 to PROD despite the freeze: fixing the outage"}
+	context.DoMessageMagic()
+	if context.FreezeOverrideReason != "fixing the outage" {
+		t.Errorf("FreezeOverrideReason is %q", context.FreezeOverrideReason)
+	}
+	if context.ArtifactsFromBuildNumber != "12" || len(context.OverrideDeployEnvironmentNames) != 1 ||
+		context.OverrideDeployEnvironmentNames[0] != "PROD" {
+		t.Errorf(
+			"artifacts %q, override %q",
+			context.ArtifactsFromBuildNumber, context.OverrideDeployEnvironmentNames,
+		)
+	}
+
+	// Without a reason the freeze is not lifted.
+	context = &Context{BuildMessage: "Deploy to PROD despite freeze:"}
+	context.DoMessageMagic()
+	if context.FreezeOverrideReason != "" {
+		t.Errorf("FreezeOverrideReason is %q", context.FreezeOverrideReason)
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+)
+
+var stepKeyUnsafeRegexp = regexp.MustCompile("[^A-Za-z0-9_-]+")
+
+// groupDependencies returns the groups that each group in the stages must
+// wait for.
+//
+// Unless byEnvironment is set this mirrors the waits between the stages:
+// each group waits for all of the groups in the stage before it. With
+// byEnvironment, the groups for an environment instead wait only for the
+// earlier groups for the same environment, and its first group waits for
+// the last groups of the environments that it's deployed to after, or for
+// the phases that run once per build if there are none.
+func groupDependencies(stages []*loweredStage, byEnvironment bool) map[*loweredGroup][]*loweredGroup {
+	deps := map[*loweredGroup][]*loweredGroup{}
+
+	// before holds the groups that the current stage waits for, and
+	// current the groups that will be waited for by the next stage.
+	var before, current []*loweredGroup
+	// perBuild holds the groups that the first groups of environments
+	// without predecessors wait for, and lastForEnv the most recent
+	// group for each environment.
+	var perBuild []*loweredGroup
+	lastForEnv := map[string]*loweredGroup{}
+
+	for _, stage := range stages {
+		if !stage.withPrevious {
+			before, current = current, nil
+			if !stage.perEnvironment {
+				perBuild = nil
+			}
+		}
+		for _, group := range stage.groups {
+			current = append(current, group)
+			if !stage.perEnvironment {
+				perBuild = append(perBuild, group)
+			}
+			if !byEnvironment || !stage.perEnvironment {
+				deps[group] = before
+				continue
+			}
+
+			if last := lastForEnv[group.environment]; last != nil {
+				deps[group] = []*loweredGroup{last}
+			} else if len(group.after) > 0 {
+				for _, envName := range group.after {
+					if last := lastForEnv[envName]; last != nil {
+						deps[group] = append(deps[group], last)
+					}
+				}
+			} else {
+				deps[group] = perBuild
+			}
+			lastForEnv[group.environment] = group
+		}
+	}
+	return deps
+}
+
+// dependsOnSteps flattens the stages into a list of steps without any
+// waits, instead giving each step a key and listing the keys of the steps
+// that it must wait for in its depends_on.
+//
+// Keys already given to steps in the pipeline file are kept, as scoped by
+// scopeStepKeys, and any depends_on that they already have is extended.
+func dependsOnSteps(stages []*loweredStage) []interface{} {
+	deps := groupDependencies(stages, true)
+	keys := map[*loweredGroup][]interface{}{}
+	bkSteps := make([]interface{}, 0, 20)
+
+	for _, stage := range stages {
+		for _, group := range stage.groups {
+			var dependsOn []interface{}
+			for _, dep := range deps[group] {
+				dependsOn = append(dependsOn, keys[dep]...)
+			}
+
+			for i, bkStep := range group.steps {
+				step, ok := bkStep.(Step)
+				if !ok {
+					bkSteps = append(bkSteps, bkStep)
+					continue
+				}
+				key, ok := step["key"].(string)
+				if !ok || key == "" {
+					key = stepKey(group, i)
+					step["key"] = key
+				}
+				keys[group] = append(keys[group], key)
+
+				if len(dependsOn) > 0 {
+					switch existing := step["depends_on"].(type) {
+					case string:
+						step["depends_on"] = appendNewKeys([]interface{}{existing}, dependsOn)
+					case []interface{}:
+						step["depends_on"] = appendNewKeys(existing, dependsOn)
+					default:
+						step["depends_on"] = dependsOn
+					}
+				}
+				bkSteps = append(bkSteps, step)
+			}
+		}
+	}
+	return bkSteps
+}
+
+// appendNewKeys appends the keys that aren't already in a depends_on list.
+func appendNewKeys(dependsOn []interface{}, keys []interface{}) []interface{} {
+	for _, key := range keys {
+		found := false
+		for _, existing := range dependsOn {
+			if existing == key {
+				found = true
+				break
+			}
+		}
+		if !found {
+			dependsOn = append(dependsOn, key)
+		}
+	}
+	return dependsOn
+}
+
+// scopeStepKeys makes the keys given to steps in the pipeline file unique
+// when the steps are copied for each environment or service, by adding
+// the environment and service to them as for generated keys, like
+// "deploy-qa" for a step with the key "deploy". A depends_on that names
+// such a key refers to the step for the same environment and service, or
+// to the step that runs once per build for the same service.
+func scopeStepKeys(stages []*loweredStage) {
+	// defined holds the keys given in each scope, which is the service
+	// and environment of a group.
+	type scope struct{ service, environment string }
+	defined := map[scope]map[string]bool{}
+	for _, stage := range stages {
+		for _, group := range stage.groups {
+			groupScope := scope{group.service, group.environment}
+			for _, bkStep := range group.steps {
+				step, ok := bkStep.(Step)
+				if !ok {
+					continue
+				}
+				if key, ok := step["key"].(string); ok && key != "" {
+					if defined[groupScope] == nil {
+						defined[groupScope] = map[string]bool{}
+					}
+					defined[groupScope][key] = true
+				}
+			}
+		}
+	}
+
+	scoped := func(group *loweredGroup, key string) string {
+		if defined[scope{group.service, group.environment}][key] {
+			return scopedStepKey(group.service, group.environment, key)
+		}
+		if defined[scope{group.service, ""}][key] {
+			return scopedStepKey(group.service, "", key)
+		}
+		return key
+	}
+
+	for _, stage := range stages {
+		for _, group := range stage.groups {
+			for _, bkStep := range group.steps {
+				step, ok := bkStep.(Step)
+				if !ok {
+					continue
+				}
+				if key, ok := step["key"].(string); ok && key != "" {
+					step["key"] = scoped(group, key)
+				}
+				switch dependsOn := step["depends_on"].(type) {
+				case string:
+					step["depends_on"] = scoped(group, dependsOn)
+				case []interface{}:
+					for i, dep := range dependsOn {
+						if depKey, ok := dep.(string); ok {
+							dependsOn[i] = scoped(group, depKey)
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+// scopedStepKey adds the environment and service to a key given in the
+// pipeline file. Keys of steps that run once per build without services
+// are unchanged.
+func scopedStepKey(service, environment, key string) string {
+	if environment != "" {
+		key += "-" + stepKeyUnsafeRegexp.ReplaceAllString(environment, "_")
+	}
+	if service != "" {
+		key = stepKeyUnsafeRegexp.ReplaceAllString(service, "_") + "-" + key
+	}
+	return key
+}
+
+// stepKey returns the key for the step at the given index in a group,
+// like "deploy-qa-1", which stays the same from build to build.
+func stepKey(group *loweredGroup, index int) string {
+	base := group.phase
+	if group.environment != "" {
+		base += "-" + group.environment
+	}
+	if group.service != "" {
+		base = group.service + "-" + base
+	}
+	return fmt.Sprintf("%s-%d", stepKeyUnsafeRegexp.ReplaceAllString(base, "_"), index+1)
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// contextSettings collects repeated name=value flags, each naming one of
+// the render flags.
+type contextSettings []string
+
+func (s *contextSettings) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *contextSettings) Set(value string) error {
+	if !strings.Contains(value, "=") {
+		return fmt.Errorf("%q is not in the form name=value", value)
+	}
+	*s = append(*s, value)
+	return nil
+}
+
+// diffSide is one of the two pipelines being compared.
+type diffSide struct {
+	filename string
+	settings contextSettings
+}
+
+func (s *diffSide) String() string {
+	if len(s.settings) == 0 {
+		return s.filename
+	}
+	return fmt.Sprintf("%s (%s)", s.filename, strings.Join(s.settings, ", "))
+}
+
+// diffCommand implements "jobsworth diff <old-file> [<new-file>]", which
+// compares the steps generated from two pipeline files, or from one file
+// for two different builds. It returns 0 if the steps are the same, 1 if
+// they differ and 2 if they couldn't be generated, like diff(1).
+func diffCommand(args []string) int {
+	var common contextSettings
+	var a, b diffSide
+	flags := flag.NewFlagSet("diff", flag.ExitOnError)
+	flags.Var(&common, "context", "a render setting for both builds, like branch=master (repeatable)")
+	flags.Var(&a.settings, "context-a", "a render setting for the old build only (repeatable)")
+	flags.Var(&b.settings, "context-b", "a render setting for the new build only (repeatable)")
+	flags.Parse(args)
+
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		fmt.Fprintf(os.Stderr, "Usage: jobsworth diff [options] <old-pipeline-file> [<new-pipeline-file>]\n\n")
+		flags.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nSettings are named after the flags of jobsworth render.\n")
+		return 2
+	}
+	a.filename = flags.Arg(0)
+	b.filename = flags.Arg(flags.NArg() - 1)
+
+	// Both builds are for a commit made at the same time, and start at
+	// the same time, so that the code versions and deploy freezes only
+	// differ if something else about them does.
+	now := time.Now().UTC().Format(time.RFC3339)
+	defaults := contextSettings{"commit-time=" + now, "build-time=" + now}
+	aSettings := append(append(append(contextSettings{}, defaults...), common...), a.settings...)
+	bSettings := append(append(append(contextSettings{}, defaults...), common...), b.settings...)
+
+	aSteps, err := renderPipelineSteps(a.filename, aSettings, os.Stderr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", &a, err)
+		return 2
+	}
+	bSteps, err := renderPipelineSteps(b.filename, bSettings, os.Stderr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", &b, err)
+		return 2
+	}
+
+	fmt.Printf("--- %s\n+++ %s\n", &a, &b)
+	if !writeStepsDiff(os.Stdout, aSteps, bSteps) {
+		return 0
+	}
+	return 1
+}
+
+// renderPipelineSteps generates the steps for the given pipeline file, in
+// a build described by render settings, and returns them as they would be
+// uploaded to Buildkite. What generating them reports is written to out, so
+// that it stays apart from the diff.
+func renderPipelineSteps(filename string, settings []string, out io.Writer) ([]interface{}, error) {
+	context := newRenderContext()
+	context.ConfigFilename = filename
+	flags := flag.NewFlagSet("context", flag.ContinueOnError)
+	options := renderFlags(flags, context)
+
+	setFlags := map[string]bool{}
+	for _, setting := range settings {
+		parts := strings.SplitN(setting, "=", 2)
+		if flags.Lookup(parts[0]) == nil {
+			return nil, fmt.Errorf("unknown context setting %q", parts[0])
+		}
+		if err := flags.Set(parts[0], parts[1]); err != nil {
+			return nil, fmt.Errorf("invalid context setting %s: %s", setting, err)
+		}
+		setFlags[parts[0]] = true
+	}
+	if err := finishRenderContext(context, options, setFlags); err != nil {
+		return nil, err
+	}
+
+	bkSteps, _, err := generateSteps(context, &DryRunBuildMetadataClient{}, out)
+	if err != nil {
+		return nil, err
+	}
+
+	// Round-trip the steps through YAML so that the comparison is of
+	// exactly what would be uploaded.
+	stepsYaml, err := MarshalPipelineSteps(bkSteps)
+	if err != nil {
+		return nil, fmt.Errorf("Error marshalling steps as yaml: %s", err)
+	}
+	var uploaded struct {
+		Steps []interface{} `yaml:"steps"`
+	}
+	if err := yaml.Unmarshal(stepsYaml, &uploaded); err != nil {
+		return nil, err
+	}
+	return uploaded.Steps, nil
+}
+
+// writeStepsDiff writes the differences between two lists of steps to w,
+// returning true if there were any.
+//
+// Steps are matched up by their identity, which is their name along with
+// the queue and environment they run in, so that a change to a step is
+// shown as changes to its fields rather than as a removal and an addition.
+func writeStepsDiff(w io.Writer, a, b []interface{}) bool {
+	aIds := make([]string, len(a))
+	for i, step := range a {
+		aIds[i] = stepIdentity(step)
+	}
+	bIds := make([]string, len(b))
+	for i, step := range b {
+		bIds[i] = stepIdentity(step)
+	}
+
+	// lcs[i][j] is the length of the longest common subsequence of
+	// aIds[i:] and bIds[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if aIds[i] == bIds[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	changed := false
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && aIds[i] == bIds[j]:
+			aFields := flattenStep(a[i])
+			bFields := flattenStep(b[j])
+			if lines := diffFields(aFields, bFields); len(lines) > 0 {
+				fmt.Fprintf(w, "  step %d: %s\n", j+1, bIds[j])
+				for _, line := range lines {
+					fmt.Fprintf(w, "%s\n", line)
+				}
+				changed = true
+			}
+			i++
+			j++
+		case j < len(b) && (i == len(a) || lcs[i][j+1] >= lcs[i+1][j]):
+			writeWholeStep(w, "+", j+1, bIds[j], b[j])
+			changed = true
+			j++
+		default:
+			writeWholeStep(w, "-", i+1, aIds[i], a[i])
+			changed = true
+			i++
+		}
+	}
+	return changed
+}
+
+func writeWholeStep(w io.Writer, marker string, number int, id string, step interface{}) {
+	fmt.Fprintf(w, "%s step %d: %s\n", marker, number, id)
+	if _, ok := step.(map[interface{}]interface{}); !ok {
+		// Bare steps, like "wait", are fully described by their identity.
+		return
+	}
+	fields := flattenStep(step)
+	for _, path := range sortedFieldPaths(fields) {
+		fmt.Fprintf(w, "%s   %s: %s\n", marker, path, fields[path])
+	}
+}
+
+// stepIdentity describes a step by the things that distinguish it from
+// other steps in the same pipeline.
+func stepIdentity(step interface{}) string {
+	stepMap, ok := step.(map[interface{}]interface{})
+	if !ok {
+		return fmt.Sprint(step)
+	}
+
+	var name string
+	for _, key := range []string{"name", "label", "block", "input", "trigger", "group"} {
+		if value, ok := stepMap[key]; ok && value != nil {
+			name = fmt.Sprintf("%v", value)
+			break
+		}
+	}
+	if name == "" {
+		if _, ok := stepMap["wait"]; ok {
+			name = "wait"
+		}
+	}
+
+	var where []string
+	if agents, ok := stepMap["agents"].(map[interface{}]interface{}); ok {
+		if queue, ok := agents["queue"]; ok {
+			where = append(where, fmt.Sprintf("queue %v", queue))
+		}
+	}
+	if env, ok := stepMap["env"].(map[interface{}]interface{}); ok {
+		if envName, ok := env["JOBSWORTH_ENVIRONMENT"]; ok {
+			where = append(where, fmt.Sprintf("environment %v", envName))
+		}
+	}
+
+	id := fmt.Sprintf("%q", name)
+	if len(where) > 0 {
+		id += " (" + strings.Join(where, ", ") + ")"
+	}
+	return id
+}
+
+// flattenStep returns the scalar values within a step, keyed by their
+// dotted path, like "agents.queue" or "commands[1]".
+func flattenStep(step interface{}) map[string]string {
+	fields := map[string]string{}
+	flattenValue(fields, "", step)
+	return fields
+}
+
+func flattenValue(fields map[string]string, path string, value interface{}) {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		for key, item := range v {
+			itemPath := fmt.Sprint(key)
+			if path != "" {
+				itemPath = path + "." + itemPath
+			}
+			flattenValue(fields, itemPath, item)
+		}
+	case []interface{}:
+		for i, item := range v {
+			flattenValue(fields, fmt.Sprintf("%s[%d]", path, i), item)
+		}
+	case string:
+		if v == "" || strings.ContainsAny(v, "\n\"") || strings.TrimSpace(v) != v {
+			fields[path] = fmt.Sprintf("%q", v)
+		} else {
+			fields[path] = v
+		}
+	default:
+		fields[path] = fmt.Sprint(v)
+	}
+}
+
+// diffFields returns a line for each field that was removed, added or
+// changed between two flattened steps.
+func diffFields(a, b map[string]string) []string {
+	all := map[string]string{}
+	for path, value := range a {
+		all[path] = value
+	}
+	for path, value := range b {
+		all[path] = value
+	}
+
+	var lines []string
+	for _, path := range sortedFieldPaths(all) {
+		aValue, inA := a[path]
+		bValue, inB := b[path]
+		if inA && inB && aValue == bValue {
+			continue
+		}
+		if inA {
+			lines = append(lines, fmt.Sprintf("-   %s: %s", path, aValue))
+		}
+		if inB {
+			lines = append(lines, fmt.Sprintf("+   %s: %s", path, bValue))
+		}
+	}
+	return lines
+}
+
+func sortedFieldPaths(fields map[string]string) []string {
+	paths := make([]string, 0, len(fields))
+	for path := range fields {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
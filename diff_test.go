@@ -0,0 +1,88 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestWriteStepsDiff(t *testing.T) {
+	parse := func(source string) []interface{} {
+		var steps []interface{}
+		if err := yaml.Unmarshal([]byte(source), &steps); err != nil {
+			t.Fatal(err)
+		}
+		return steps
+	}
+	a := parse(`
+- name: build
+  command: make
+  agents: {queue: build}
+- wait
+- name: deploy
+  command: deploy qa
+  env: {JOBSWORTH_ENVIRONMENT: qa}
+- wait
+- name: deploy
+  command: deploy prod
+  env: {JOBSWORTH_ENVIRONMENT: prod}
+`)
+	b := parse(`
+- name: build
+  command: make
+  agents: {queue: build}
+- wait
+- name: deploy
+  command: deploy-v2 qa
+  env: {JOBSWORTH_ENVIRONMENT: qa}
+- wait
+- name: smoke
+  commands: [check qa]
+  env: {JOBSWORTH_ENVIRONMENT: qa}
+`)
+
+	var out strings.Builder
+	if !writeStepsDiff(&out, a, b) {
+		t.Errorf("no differences found")
+	}
+	want := `  step 3: "deploy" (environment qa)
+-   command: deploy qa
++   command: deploy-v2 qa
++ step 5: "smoke" (environment qa)
++   commands[0]: check qa
++   env.JOBSWORTH_ENVIRONMENT: qa
++   name: smoke
+- step 5: "deploy" (environment prod)
+-   command: deploy prod
+-   env.JOBSWORTH_ENVIRONMENT: prod
+-   name: deploy
+`
+	if out.String() != want {
+		t.Errorf("got diff\n%s\nwant\n%s", out.String(), want)
+	}
+
+	out.Reset()
+	if writeStepsDiff(&out, a, a) || out.Len() != 0 {
+		t.Errorf("identical steps have differences:\n%s", out.String())
+	}
+}
+
+func TestRenderPipelineStepsStatus(t *testing.T) {
+	var status strings.Builder
+	steps, err := renderPipelineSteps(
+		"testdata/environments.in.yaml",
+		[]string{"trailer=Jobsworth-Skip=validation_test"},
+		&status,
+	)
+	if err != nil {
+		t.Fatal("renderPipelineSteps returned err:", err)
+	}
+	if len(steps) == 0 {
+		t.Error("no steps were rendered")
+	}
+	want := "Override skip: validation_test (from commit trailer Jobsworth-Skip)\n"
+	if status.String() != want {
+		t.Errorf("got status %q, want %q", status.String(), want)
+	}
+}
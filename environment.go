@@ -0,0 +1,285 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Environment is a single deployment target in the pipeline's promotion
+// graph.
+type Environment struct {
+	// After lists the environments whose deploy and validation steps must
+	// complete before this environment is deployed to.
+	After []string `yaml:"after"`
+
+	Cautious bool `yaml:"cautious"`
+
+	// Variables are made available to interpolation in the environment's
+	// steps with an "env." prefix, like ${env.region}.
+	Variables map[string]string `yaml:"variables"`
+
+	// Env is merged into the env of each of the environment's steps.
+	// Variables set by the step itself take priority.
+	Env map[string]string `yaml:"env"`
+
+	// Agents overrides agent tags for each of the environment's steps,
+	// including the default "environment" tag.
+	Agents map[string]string `yaml:"agents"`
+
+	// Queue, if set, overrides the phase's queue for each of the
+	// environment's steps.
+	Queue string `yaml:"queue"`
+
+	// RequireApproval, if set, overrides whether deploys to the
+	// environment wait for the pipeline's approval step, which otherwise
+	// only applies to cautious environments.
+	RequireApproval *bool `yaml:"require_approval"`
+}
+
+// environmentGraph returns the environments to deploy to, keyed by name,
+// along with their names in a stable order.
+//
+// Pipelines that still use the trivial_deploy_environments and
+// cautious_deploy_environments lists are translated into an equivalent
+// graph: all of the trivial environments first, then each of the cautious
+// environments in turn.
+func (p *Pipeline) environmentGraph() (map[string]*Environment, []string, error) {
+	if len(p.Environments) > 0 {
+		if len(p.TrivialDeployEnvs) > 0 || len(p.CautiousDeployEnvs) > 0 {
+			return nil, nil, fmt.Errorf(
+				"environments cannot be combined with trivial_deploy_environments or cautious_deploy_environments",
+			)
+		}
+
+		names := make([]string, 0, len(p.Environments))
+		for name, env := range p.Environments {
+			if env == nil {
+				p.Environments[name] = &Environment{}
+			}
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return p.Environments, names, nil
+	}
+
+	envs := map[string]*Environment{}
+	names := make([]string, 0, len(p.TrivialDeployEnvs)+len(p.CautiousDeployEnvs))
+	for _, name := range p.TrivialDeployEnvs {
+		envs[name] = &Environment{}
+		names = append(names, name)
+	}
+	var after []string
+	if len(p.TrivialDeployEnvs) > 0 {
+		after = p.TrivialDeployEnvs
+	}
+	for _, name := range p.CautiousDeployEnvs {
+		envs[name] = &Environment{
+			After:    after,
+			Cautious: true,
+		}
+		names = append(names, name)
+		after = []string{name}
+	}
+	return envs, names, nil
+}
+
+// environmentLevels groups the environments of a graph by their depth,
+// which is the length of the longest chain of "after" edges leading to
+// them. All of the environments in a level can be deployed to in parallel
+// once every environment in the earlier levels has been validated.
+//
+// Within each level the environments retain the order given in names.
+func environmentLevels(envs map[string]*Environment, names []string) ([][]string, error) {
+	depths := make(map[string]int, len(envs))
+	visiting := map[string]bool{}
+
+	var depthOf func(name string, path []string) (int, error)
+	depthOf = func(name string, path []string) (int, error) {
+		if depth, ok := depths[name]; ok {
+			return depth, nil
+		}
+		path = append(path, name)
+		if visiting[name] {
+			return 0, fmt.Errorf(
+				"environment dependency cycle: %s", strings.Join(path, " -> "),
+			)
+		}
+		visiting[name] = true
+
+		depth := 0
+		for _, prevName := range envs[name].After {
+			if _, ok := envs[prevName]; !ok {
+				return 0, fmt.Errorf(
+					"environment %s is after unknown environment %s",
+					name, prevName,
+				)
+			}
+			prevDepth, err := depthOf(prevName, path)
+			if err != nil {
+				return 0, err
+			}
+			if prevDepth+1 > depth {
+				depth = prevDepth + 1
+			}
+		}
+
+		visiting[name] = false
+		depths[name] = depth
+		return depth, nil
+	}
+
+	var levels [][]string
+	for _, name := range names {
+		depth, err := depthOf(name, nil)
+		if err != nil {
+			return nil, err
+		}
+		for len(levels) <= depth {
+			levels = append(levels, nil)
+		}
+		levels[depth] = append(levels[depth], name)
+	}
+	return levels, nil
+}
+
+// restrictEnvironments returns a copy of the graph that only includes the
+// named environments. Ordering between the remaining environments is
+// preserved even when the environments between them are removed.
+func restrictEnvironments(envs map[string]*Environment, names []string, keep []string) (map[string]*Environment, []string, error) {
+	kept := make(map[string]bool, len(keep))
+	for _, name := range keep {
+		if _, ok := envs[name]; !ok {
+			return nil, nil, fmt.Errorf("unknown environment %s", name)
+		}
+		kept[name] = true
+	}
+
+	// keptAncestors finds the nearest kept environments that the given
+	// environment is after.
+	var keptAncestors func(name string, seen map[string]bool) []string
+	keptAncestors = func(name string, seen map[string]bool) []string {
+		var ret []string
+		for _, prevName := range envs[name].After {
+			if seen[prevName] {
+				continue
+			}
+			seen[prevName] = true
+			if kept[prevName] {
+				ret = append(ret, prevName)
+			} else if _, ok := envs[prevName]; ok {
+				ret = append(ret, keptAncestors(prevName, seen)...)
+			}
+		}
+		return ret
+	}
+
+	restrictedEnvs := make(map[string]*Environment, len(keep))
+	restrictedNames := make([]string, 0, len(keep))
+	for _, name := range names {
+		if !kept[name] {
+			continue
+		}
+		env := *envs[name]
+		env.After = keptAncestors(name, map[string]bool{})
+		restrictedEnvs[name] = &env
+		restrictedNames = append(restrictedNames, name)
+	}
+	return restrictedEnvs, restrictedNames, nil
+}
+
+// agentEnvironmentTag returns the value of the "environment" agent tag for
+// the steps of the named environment.
+func (p *Pipeline) agentEnvironmentTag(name string) string {
+	if env := p.Environments[name]; env != nil {
+		if tag, ok := env.Agents["environment"]; ok {
+			return tag
+		}
+	}
+	return name
+}
+
+// deployEnvironments returns the graph of environments that the build
+// described by the context deploys to under the given rule.
+func (p *Pipeline) deployEnvironments(context *Context, rule *BranchRule) (map[string]*Environment, []string, error) {
+	envs, envNames, err := p.environmentGraph()
+	if err != nil {
+		return nil, nil, err
+	}
+	declared := make(map[string]bool, len(envNames))
+	for _, name := range envNames {
+		declared[name] = true
+	}
+
+	if rule.Environments != nil {
+		envs, envNames, err = restrictEnvironments(envs, envNames, rule.Environments)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %s", rule, err)
+		}
+	}
+
+	// The environments given as an override limit the deploy further,
+	// unless the build message names an environment to deploy to. With
+	// services, each service deploys to those of them that it has.
+	if overrideEnvs := context.Overrides.Environments; overrideEnvs != nil && len(context.OverrideDeployEnvironmentNames) == 0 {
+		var keep []string
+		for _, name := range overrideEnvs {
+			if _, ok := envs[name]; ok {
+				keep = append(keep, name)
+			}
+		}
+		envs, envNames, err = restrictEnvironments(envs, envNames, keep)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	previewName, preview, err := p.previewEnvironment(context)
+	if err != nil {
+		return nil, nil, err
+	}
+	if previewName != "" {
+		if _, exists := envs[previewName]; exists {
+			return nil, nil, fmt.Errorf(
+				"pull request preview environment %s is also a declared environment",
+				previewName,
+			)
+		}
+		envs[previewName] = preview
+		envNames = append(envNames, previewName)
+	}
+
+	if overrideNames := context.OverrideDeployEnvironmentNames; len(overrideNames) > 0 {
+		// With services, each service deploys to those of them that it
+		// declares or allows as adhoc environments, unless the deploy
+		// is forced.
+		if context.ServiceName != "" && !context.ForceOverrideEnvironments {
+			var keep []string
+			for _, name := range overrideNames {
+				if declared[name] || matchAnyPattern(p.AdhocEnvironments, name) {
+					keep = append(keep, name)
+				}
+			}
+			overrideNames = keep
+		}
+
+		// Custom environments are always cautious, and are deployed to
+		// one after another in the order given, but each keeps any
+		// other configuration it was declared with.
+		overrideEnvs := make(map[string]*Environment, len(overrideNames))
+		var after []string
+		for _, name := range overrideNames {
+			override := Environment{}
+			if env := envs[name]; env != nil {
+				override = *env
+			}
+			override.After = after
+			override.Cautious = true
+			overrideEnvs[name] = &override
+			after = []string{name}
+		}
+		envs, envNames = overrideEnvs, overrideNames
+	}
+
+	return envs, envNames, nil
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FreezeWindow is a period during which deploys to some environments are
+// not allowed.
+type FreezeWindow struct {
+	Name string `yaml:"name"`
+
+	// Schedule is a cron expression, like "* * * * sat,sun". The freeze
+	// applies during every minute that it matches.
+	Schedule string `yaml:"schedule"`
+
+	// From and Until, in RFC 3339 format, limit the freeze to a single
+	// period. Either may be omitted.
+	From  string `yaml:"from"`
+	Until string `yaml:"until"`
+
+	// Timezone is the IANA name of the timezone that the schedule is
+	// interpreted in, defaulting to UTC.
+	Timezone string `yaml:"timezone"`
+
+	// Environments lists the environments that are frozen, or all
+	// environments if empty.
+	Environments []string `yaml:"environments"`
+
+	// Action is what happens to the deploys to frozen environments:
+	// "block" (the default) replaces them with a block step explaining
+	// the freeze, while "omit" leaves them out entirely.
+	Action string `yaml:"action"`
+}
+
+// validate checks that the freeze window is well-formed.
+func (w *FreezeWindow) validate() error {
+	if w.Schedule == "" && w.From == "" && w.Until == "" {
+		return fmt.Errorf("must have a schedule, from or until")
+	}
+	if w.Schedule != "" {
+		if _, err := parseCronSchedule(w.Schedule); err != nil {
+			return fmt.Errorf("schedule %q: %s", w.Schedule, err)
+		}
+	}
+	for _, bound := range []string{w.From, w.Until} {
+		if bound == "" {
+			continue
+		}
+		if _, err := time.Parse(time.RFC3339, bound); err != nil {
+			return fmt.Errorf("invalid time %q: %s", bound, err)
+		}
+	}
+	if _, err := time.LoadLocation(w.Timezone); err != nil {
+		return fmt.Errorf("invalid timezone %q: %s", w.Timezone, err)
+	}
+	if w.Action != "" && w.Action != "block" && w.Action != "omit" {
+		return fmt.Errorf("action must be block or omit, not %q", w.Action)
+	}
+	return nil
+}
+
+// String describes the window, for explaining why a deploy was frozen.
+func (w *FreezeWindow) String() string {
+	if w.Name != "" {
+		return w.Name
+	}
+	if w.Schedule != "" {
+		return fmt.Sprintf("schedule %q", w.Schedule)
+	}
+	return "deploy freeze"
+}
+
+// activeAt returns true if the window is in effect at the given time. The
+// window must already have been validated.
+func (w *FreezeWindow) activeAt(now time.Time) bool {
+	if w.From != "" {
+		from, _ := time.Parse(time.RFC3339, w.From)
+		if now.Before(from) {
+			return false
+		}
+	}
+	if w.Until != "" {
+		until, _ := time.Parse(time.RFC3339, w.Until)
+		if !now.Before(until) {
+			return false
+		}
+	}
+	if w.Schedule != "" {
+		location, _ := time.LoadLocation(w.Timezone)
+		schedule, _ := parseCronSchedule(w.Schedule)
+		return schedule.matches(now.In(location))
+	}
+	return true
+}
+
+// appliesTo returns true if the window freezes the named environment.
+func (w *FreezeWindow) appliesTo(environmentName string) bool {
+	if len(w.Environments) == 0 {
+		return true
+	}
+	for _, name := range w.Environments {
+		if name == environmentName {
+			return true
+		}
+	}
+	return false
+}
+
+// frozenEnvironments returns the freeze windows that are in effect for
+// each of the named environments at the time of the build, leaving out
+// environments that aren't frozen.
+func (p *Pipeline) frozenEnvironments(context *Context, envNames []string) map[string]*FreezeWindow {
+	frozen := map[string]*FreezeWindow{}
+	if context.FreezeOverrideReason != "" {
+		// The override only ever deploys to the environment it names.
+		return frozen
+	}
+	for _, window := range p.Freeze {
+		if window == nil || !window.activeAt(context.BuildTime) {
+			continue
+		}
+		for _, envName := range envNames {
+			if _, ok := frozen[envName]; !ok && window.appliesTo(envName) {
+				frozen[envName] = window
+			}
+		}
+	}
+	return frozen
+}
+
+// freezeStep returns the block step that replaces the deploy to an
+// environment that is frozen.
+func freezeStep(environmentName string, window *FreezeWindow) Step {
+	label := fmt.Sprintf("%s is frozen", environmentName)
+	return Step{
+		"block": label,
+		"name":  label,
+		"prompt": fmt.Sprintf(
+			"Deploys to %s are frozen by %s. To deploy anyway, start a "+
+				"build with the message \"Deploy to %s despite freeze: <reason>\".",
+			environmentName, window, environmentName,
+		),
+	}
+}
+
+// cronSchedule is a parsed five-field cron expression, holding the values
+// that each field matches.
+type cronSchedule struct {
+	minutes, hours, daysOfMonth, months, daysOfWeek map[int]bool
+	// Like cron, when both the day of the month and day of the week are
+	// restricted, a time matches if either of them does.
+	anyDayOfMonth, anyDayOfWeek bool
+}
+
+var cronMonthNames = map[string]int{
+	"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+	"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+}
+
+var cronDayNames = map[string]int{
+	"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+}
+
+func parseCronSchedule(expr string) (*cronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("expected 5 fields, not %d", len(fields))
+	}
+	var err error
+	schedule := &cronSchedule{
+		anyDayOfMonth: fields[2] == "*",
+		anyDayOfWeek:  fields[4] == "*",
+	}
+	if schedule.minutes, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+		return nil, fmt.Errorf("minute: %s", err)
+	}
+	if schedule.hours, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+		return nil, fmt.Errorf("hour: %s", err)
+	}
+	if schedule.daysOfMonth, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+		return nil, fmt.Errorf("day of month: %s", err)
+	}
+	if schedule.months, err = parseCronField(fields[3], 1, 12, cronMonthNames); err != nil {
+		return nil, fmt.Errorf("month: %s", err)
+	}
+	if schedule.daysOfWeek, err = parseCronField(fields[4], 0, 7, cronDayNames); err != nil {
+		return nil, fmt.Errorf("day of week: %s", err)
+	}
+	if schedule.daysOfWeek[7] {
+		// Both 0 and 7 mean Sunday.
+		schedule.daysOfWeek[0] = true
+	}
+	return schedule, nil
+}
+
+// parseCronField parses a comma-separated list of values, ranges like
+// 1-5 and steps like */15 or 0-30/10 into the set of values it matches.
+func parseCronField(field string, min, max int, names map[string]int) (map[int]bool, error) {
+	parseValue := func(s string) (int, error) {
+		if value, ok := names[strings.ToLower(s)]; ok {
+			return value, nil
+		}
+		value, err := strconv.Atoi(s)
+		if err != nil {
+			return 0, fmt.Errorf("invalid value %q", s)
+		}
+		if value < min || value > max {
+			return 0, fmt.Errorf("%d is not between %d and %d", value, min, max)
+		}
+		return value, nil
+	}
+
+	values := map[int]bool{}
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step < 1 {
+				return nil, fmt.Errorf("invalid step %q", part[i+1:])
+			}
+			part = part[:i]
+		}
+
+		start, end := min, max
+		if part != "*" {
+			var err error
+			bounds := strings.SplitN(part, "-", 2)
+			if start, err = parseValue(bounds[0]); err != nil {
+				return nil, err
+			}
+			end = start
+			if len(bounds) == 2 {
+				if end, err = parseValue(bounds[1]); err != nil {
+					return nil, err
+				}
+				if end < start {
+					return nil, fmt.Errorf("range %q is backwards", part)
+				}
+			} else if step > 1 {
+				// Like cron, "5/15" means every 15 from 5.
+				end = max
+			}
+		}
+		for value := start; value <= end; value += step {
+			values[value] = true
+		}
+	}
+	return values, nil
+}
+
+func (s *cronSchedule) matches(t time.Time) bool {
+	if !s.minutes[t.Minute()] || !s.hours[t.Hour()] || !s.months[int(t.Month())] {
+		return false
+	}
+	dayOfMonth := s.daysOfMonth[t.Day()]
+	dayOfWeek := s.daysOfWeek[int(t.Weekday())]
+	if s.anyDayOfMonth || s.anyDayOfWeek {
+		return dayOfMonth && dayOfWeek
+	}
+	return dayOfMonth || dayOfWeek
+}
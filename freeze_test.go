@@ -0,0 +1,143 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+)
+
+func TestCronSchedule(t *testing.T) {
+	// 2026-10-16 is a Friday.
+	friday := time.Date(2026, 10, 16, 17, 30, 0, 0, time.UTC)
+	saturday := time.Date(2026, 10, 17, 9, 0, 0, 0, time.UTC)
+	sunday := time.Date(2026, 10, 18, 23, 59, 0, 0, time.UTC)
+
+	tests := []struct {
+		schedule string
+		time     time.Time
+		matches  bool
+	}{
+		{"* * * * *", friday, true},
+		{"* * * * sat,sun", friday, false},
+		{"* * * * sat,sun", saturday, true},
+		{"* * * * 6-7", sunday, true},
+		{"* 17-23 * * fri", friday, true},
+		{"* 18-23 * * fri", friday, false},
+		{"*/15 * * * *", friday, true},
+		{"*/20 * * * *", friday, false},
+		{"* * 20-31 dec *", friday, false},
+		{"* * 16 oct *", friday, true},
+		// When both days are restricted, either can match.
+		{"* * 1 * fri", friday, true},
+		{"* * 16 * mon", friday, true},
+		{"* * 1 * mon", friday, false},
+	}
+	for _, test := range tests {
+		schedule, err := parseCronSchedule(test.schedule)
+		if err != nil {
+			t.Errorf("%q: %s", test.schedule, err)
+			continue
+		}
+		if schedule.matches(test.time) != test.matches {
+			t.Errorf("%q matching %s should be %v", test.schedule, test.time, test.matches)
+		}
+	}
+
+	for _, schedule := range []string{"* * * *", "60 * * * *", "* * * * funday", "5-1 * * * *", "*/0 * * * *"} {
+		if _, err := parseCronSchedule(schedule); err == nil {
+			t.Errorf("%q should be invalid", schedule)
+		}
+	}
+}
+
+func TestFreezeWindowActive(t *testing.T) {
+	window := &FreezeWindow{
+		Schedule: "* 9-17 * * *",
+		Timezone: "America/New_York",
+		From:     "2026-12-20T00:00:00Z",
+		Until:    "2027-01-04T00:00:00Z",
+	}
+	if err := window.validate(); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		time   time.Time
+		active bool
+	}{
+		{time.Date(2026, 12, 21, 15, 0, 0, 0, time.UTC), true},
+		// 9am UTC is still the early morning in New York.
+		{time.Date(2026, 12, 21, 9, 0, 0, 0, time.UTC), false},
+		{time.Date(2026, 12, 19, 15, 0, 0, 0, time.UTC), false},
+		{time.Date(2027, 1, 4, 15, 0, 0, 0, time.UTC), false},
+	}
+	for _, test := range tests {
+		if window.activeAt(test.time) != test.active {
+			t.Errorf("window at %s should be active: %v", test.time, test.active)
+		}
+	}
+}
+
+func TestFreeze(t *testing.T) {
+	saturday := time.Date(2026, 10, 17, 9, 0, 0, 0, time.UTC)
+	monday := time.Date(2026, 10, 19, 9, 0, 0, 0, time.UTC)
+
+	deployedEnvs := func(bkSteps []interface{}) []string {
+		var envs []string
+		for _, bkStep := range bkSteps {
+			if step, ok := bkStep.(Step); ok && step["command"] == "make deploy" {
+				envs = append(envs, step["agents"].(map[interface{}]interface{})["environment"].(string))
+			}
+		}
+		return envs
+	}
+
+	tests := []struct {
+		buildTime    time.Time
+		message      string
+		deployedEnvs []string
+		blocked      string
+	}{
+		{monday, "", []string{"dev", "qa", "prod"}, ""},
+		{saturday, "", []string{"dev"}, "prod"},
+		{saturday, "Deploy to prod despite freeze: fixing the outage", []string{"prod"}, ""},
+	}
+	for _, test := range tests {
+		context := &Context{
+			ConfigFilename: "testdata/freeze.in.yaml",
+			BranchName:     "master",
+			BuildTime:      test.buildTime,
+			BuildMessage:   test.message,
+		}
+		context.DoMessageMagic()
+		bkSteps, metadata, err := generateSteps(context, &DryRunBuildMetadataClient{}, io.Discard)
+		if err != nil {
+			t.Fatal("generateSteps returned err:", err)
+		}
+		if diff := deep.Equal(test.deployedEnvs, deployedEnvs(bkSteps)); diff != nil {
+			t.Error(test.buildTime, test.message, diff)
+		}
+
+		var blocked string
+		for _, bkStep := range bkSteps {
+			if step, ok := bkStep.(Step); ok && step["block"] != nil {
+				blocked = step["block"].(string)
+				if !strings.Contains(step["prompt"].(string), "frozen by weekend") {
+					t.Error("block step should explain the freeze", step["prompt"])
+				}
+			}
+		}
+		if test.blocked != "" && blocked != test.blocked+" is frozen" {
+			t.Errorf("%s: expected a block step for %s, got %q", test.buildTime, test.blocked, blocked)
+		}
+		if test.blocked == "" && blocked != "" {
+			t.Errorf("%s: unexpected block step %q", test.buildTime, blocked)
+		}
+
+		if test.message != "" && metadata["jobsworth:freeze_override_reason"] != "fixing the outage" {
+			t.Error("the override reason should be recorded", metadata)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// stepGraph is the lowered pipeline as a dependency graph between groups
+// of steps.
+type stepGraph struct {
+	groups []*graphGroup
+	// edges are pairs of indexes into groups, from the group that must
+	// finish first to the group that waits for it.
+	edges [][2]int
+}
+
+type graphGroup struct {
+	label      string
+	stepLabels []string
+}
+
+// newStepGraph converts lowered stages into a dependency graph, with the
+// dependencies that groupDependencies finds between them.
+func newStepGraph(stages []*loweredStage, byEnvironment bool) *stepGraph {
+	graph := &stepGraph{}
+	deps := groupDependencies(stages, byEnvironment)
+	indexes := map[*loweredGroup]int{}
+	for _, stage := range stages {
+		for _, group := range stage.groups {
+			index := len(graph.groups)
+			indexes[group] = index
+			graph.groups = append(graph.groups, newGraphGroup(group))
+			for _, dep := range deps[group] {
+				graph.edges = append(graph.edges, [2]int{indexes[dep], index})
+			}
+		}
+	}
+	return graph
+}
+
+// newServicesGraph converts the lowered stages of each service into a
+// single dependency graph. With waits the services run one after another,
+// but with depends_on they are independent of each other.
+func newServicesGraph(serviceStages [][]*loweredStage, byEnvironment bool) *stepGraph {
+	if !byEnvironment {
+		var stages []*loweredStage
+		for _, s := range serviceStages {
+			stages = append(stages, s...)
+		}
+		return newStepGraph(stages, false)
+	}
+	graph := &stepGraph{}
+	for _, stages := range serviceStages {
+		serviceGraph := newStepGraph(stages, true)
+		offset := len(graph.groups)
+		graph.groups = append(graph.groups, serviceGraph.groups...)
+		for _, edge := range serviceGraph.edges {
+			graph.edges = append(graph.edges, [2]int{edge[0] + offset, edge[1] + offset})
+		}
+	}
+	return graph
+}
+
+func newGraphGroup(group *loweredGroup) *graphGroup {
+	label := group.phase
+	if group.environment != "" {
+		label = fmt.Sprintf("%s (%s)", group.phase, group.environment)
+	}
+	if group.service != "" {
+		label = fmt.Sprintf("%s: %s", group.service, label)
+	}
+	graphGroup := &graphGroup{label: label}
+	for _, step := range group.steps {
+		graphGroup.stepLabels = append(graphGroup.stepLabels, stepLabel(step))
+	}
+	return graphGroup
+}
+
+// stepLabel returns the text that Buildkite would show for a step. Steps
+// whose name is only the phase's emoji are labelled with their command.
+func stepLabel(step interface{}) string {
+	stepMap, ok := step.(Step)
+	if !ok {
+		return fmt.Sprint(step)
+	}
+	for _, key := range []string{"name", "label", "block", "input", "trigger", "group"} {
+		value, ok := stepMap[key].(string)
+		if !ok || value == "" {
+			continue
+		}
+		if !strings.Contains(value, " ") {
+			if command := stepCommand(stepMap); command != "" {
+				value += " " + command
+			}
+		}
+		return value
+	}
+	if _, ok := stepMap["wait"]; ok {
+		return "wait"
+	}
+	return "step"
+}
+
+// stepCommand returns the first line of a command step's command.
+func stepCommand(step Step) string {
+	command, _ := step["command"].(string)
+	if commands, ok := step["commands"].([]interface{}); ok && len(commands) > 0 {
+		command, _ = commands[0].(string)
+	}
+	return strings.SplitN(strings.TrimSpace(command), "\n", 2)[0]
+}
+
+// writeDot writes the graph in Graphviz's DOT language, with a cluster
+// for each group of steps.
+func (g *stepGraph) writeDot(w io.Writer) {
+	fmt.Fprintf(w, "digraph pipeline {\n")
+	fmt.Fprintf(w, "  compound=true;\n")
+	fmt.Fprintf(w, "  node [shape=box];\n")
+	for i, group := range g.groups {
+		fmt.Fprintf(w, "  subgraph cluster_%d {\n", i)
+		fmt.Fprintf(w, "    label=%s;\n", strconv.Quote(group.label))
+		for j, label := range group.stepLabels {
+			fmt.Fprintf(w, "    s%d_%d [label=%s];\n", i, j, strconv.Quote(label))
+		}
+		fmt.Fprintf(w, "  }\n")
+	}
+	// DOT only connects nodes, so each edge between groups is drawn
+	// between their first steps and clipped to the clusters.
+	for _, edge := range g.edges {
+		fmt.Fprintf(
+			w, "  s%d_0 -> s%d_0 [ltail=cluster_%d, lhead=cluster_%d];\n",
+			edge[0], edge[1], edge[0], edge[1],
+		)
+	}
+	fmt.Fprintf(w, "}\n")
+}
+
+// writeMermaid writes the graph as a Mermaid flowchart, with a subgraph
+// for each group of steps.
+func (g *stepGraph) writeMermaid(w io.Writer) {
+	fmt.Fprintf(w, "flowchart TD\n")
+	for i, group := range g.groups {
+		fmt.Fprintf(w, "  subgraph g%d [\"%s\"]\n", i, mermaidEscape(group.label))
+		for j, label := range group.stepLabels {
+			fmt.Fprintf(w, "    s%d_%d[\"%s\"]\n", i, j, mermaidEscape(label))
+		}
+		fmt.Fprintf(w, "  end\n")
+	}
+	for _, edge := range g.edges {
+		fmt.Fprintf(w, "  g%d --> g%d\n", edge[0], edge[1])
+	}
+}
+
+func mermaidEscape(s string) string {
+	return strings.NewReplacer(`"`, "#quot;", "\n", " ").Replace(s)
+}
+
+// graphCommand implements "jobsworth graph <pipeline-file>", which prints
+// the steps that would be generated for a build as a dependency graph.
+// The build is described by the same flags as for "jobsworth render". It
+// returns the exit status.
+func graphCommand(args []string) int {
+	context := newRenderContext()
+	flags := flag.NewFlagSet("graph", flag.ExitOnError)
+	format := flags.String("format", "dot", "the output format, either dot or mermaid")
+	options := renderFlags(flags, context)
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "Usage: jobsworth graph [options] <pipeline-file>\n\n")
+		flags.PrintDefaults()
+		return 1
+	}
+	context.ConfigFilename = flags.Arg(0)
+
+	var write func(*stepGraph, io.Writer)
+	switch *format {
+	case "dot":
+		write = (*stepGraph).writeDot
+	case "mermaid":
+		write = (*stepGraph).writeMermaid
+	default:
+		fmt.Fprintf(os.Stderr, "unknown graph format %q\n", *format)
+		return 1
+	}
+
+	setFlags := map[string]bool{}
+	flags.Visit(func(f *flag.Flag) {
+		setFlags[f.Name] = true
+	})
+	if err := finishRenderContext(context, options, setFlags); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+
+	// Stdout is reserved for the graph so that it can be piped elsewhere,
+	// so what preparing the pipeline reports goes to stderr.
+	pipeline, _, err := preparePipeline(context, &DryRunBuildMetadataClient{}, os.Stderr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 2
+	}
+	serviceStages, err := pipeline.lowerServiceStages(context)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error lowering pipeline: %s\n", err)
+		return 2
+	}
+	write(newServicesGraph(serviceStages, pipeline.UseDependsOn), os.Stdout)
+	return 0
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStepGraph(t *testing.T) {
+	stages := []*loweredStage{
+		{groups: []*loweredGroup{
+			{phase: "build", steps: []interface{}{
+				Step{"name": ":package:", "command": "make\nmake test"},
+				Step{"name": `:package: Build "docs"`},
+			}},
+		}},
+		{
+			groups: []*loweredGroup{
+				{phase: "skipped_deploys", steps: []interface{}{Step{"name": ":fast_forward: Skipped deploys"}}},
+			},
+			withPrevious: true,
+		},
+		{groups: []*loweredGroup{
+			{phase: "deploy", environment: "qa", steps: []interface{}{Step{"name": ":truck:", "commands": []interface{}{"deploy qa"}}}},
+			{phase: "deploy", environment: "loadtest", steps: []interface{}{Step{"name": ":truck:"}}},
+		}},
+	}
+	graph := newStepGraph(stages, false)
+
+	var mermaid strings.Builder
+	graph.writeMermaid(&mermaid)
+	wantMermaid := `flowchart TD
+  subgraph g0 ["build"]
+    s0_0[":package: make"]
+    s0_1[":package: Build #quot;docs#quot;"]
+  end
+  subgraph g1 ["skipped_deploys"]
+    s1_0[":fast_forward: Skipped deploys"]
+  end
+  subgraph g2 ["deploy (qa)"]
+    s2_0[":truck: deploy qa"]
+  end
+  subgraph g3 ["deploy (loadtest)"]
+    s3_0[":truck:"]
+  end
+  g0 --> g2
+  g1 --> g2
+  g0 --> g3
+  g1 --> g3
+`
+	if mermaid.String() != wantMermaid {
+		t.Errorf("got mermaid\n%s\nwant\n%s", mermaid.String(), wantMermaid)
+	}
+
+	var dot strings.Builder
+	graph.writeDot(&dot)
+	for _, want := range []string{
+		`label="deploy (qa)";`,
+		`s0_1 [label=":package: Build \"docs\""];`,
+		`s1_0 -> s3_0 [ltail=cluster_1, lhead=cluster_3];`,
+	} {
+		if !strings.Contains(dot.String(), want) {
+			t.Errorf("dot output does not contain %s:\n%s", want, dot.String())
+		}
+	}
+}
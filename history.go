@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// DeployRecord is the entry in the deploy history that is written to the
+// build metadata when a deploy to an environment has been validated.
+type DeployRecord struct {
+	Service        string `json:"service,omitempty"`
+	Environment    string `json:"environment"`
+	BuildNumber    uint64 `json:"build_number"`
+	Branch         string `json:"branch"`
+	CodeVersion    string `json:"code_version"`
+	SourceCommitId string `json:"source_commit_id"`
+}
+
+// DeployHistoryEntry is a deploy record read back from the metadata of an
+// earlier build, along with some details of that build.
+type DeployHistoryEntry struct {
+	DeployRecord
+	BuildState string
+	FinishedAt string
+}
+
+// deployHistoryMetadataKey returns the metadata key for a deploy to an
+// environment, which includes the service for pipelines with services, like
+// "jobsworth:deployed:web:qa", so that their deploys are kept apart.
+func deployHistoryMetadataKey(serviceName, environmentName string) string {
+	if serviceName != "" {
+		return "jobsworth:deployed:" + serviceName + ":" + environmentName
+	}
+	return "jobsworth:deployed:" + environmentName
+}
+
+// deployTarget is an environment that a build deploys to, along with the
+// service deploying to it, which is empty for pipelines without services.
+type deployTarget struct {
+	service     string
+	environment string
+}
+
+func (t deployTarget) String() string {
+	if t.service != "" {
+		return fmt.Sprintf("%s in %s", t.service, t.environment)
+	}
+	return t.environment
+}
+
+// deployTargets returns each of the environments that the build deploys
+// to, once for every service that deploys to it.
+func (p *Pipeline) deployTargets(context *Context) ([]deployTarget, error) {
+	var targets []deployTarget
+	if len(p.Services) == 0 {
+		envNames, err := p.DeployEnvironmentNames(context)
+		if err != nil {
+			return nil, err
+		}
+		for _, envName := range envNames {
+			targets = append(targets, deployTarget{environment: envName})
+		}
+		return targets, nil
+	}
+
+	for _, name := range p.serviceNames() {
+		service := p.Services[name]
+		if !context.changedPathsMatch(service.Paths) {
+			continue
+		}
+		envNames, err := service.Pipeline.DeployEnvironmentNames(service.context(context))
+		if err != nil {
+			return nil, fmt.Errorf("service %s: %s", name, err)
+		}
+		for _, envName := range envNames {
+			targets = append(targets, deployTarget{service: name, environment: envName})
+		}
+	}
+	return targets, nil
+}
+
+// deployRecordStep returns a step that records a deploy to the given
+// environment in the build metadata.
+//
+// The record is passed in the environment, rather than in the command, to
+// avoid any need to quote it for the shell.
+func deployRecordStep(context *Context, environmentName string) (Step, error) {
+	record := DeployRecord{
+		Service:        context.ServiceName,
+		Environment:    environmentName,
+		BuildNumber:    context.BuildNumber,
+		Branch:         context.BranchName,
+		CodeVersion:    context.CodeVersion,
+		SourceCommitId: context.SourceGitCommitId,
+	}
+	recordJSON, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	return Step{
+		"name": fmt.Sprintf("Record deploy to %s", environmentName),
+		// Our own interpolation turns $$$$ into $$, which then escapes
+		// the variables from Buildkite's interpolation at upload time so
+		// that the shell expands them instead.
+		"command": fmt.Sprintf(
+			`buildkite-agent meta-data set "%s$$$$JOBSWORTH_ENVIRONMENT" "$$$$JOBSWORTH_DEPLOY_RECORD"`,
+			deployHistoryMetadataKey(context.ServiceName, ""),
+		),
+		"env": map[interface{}]interface{}{
+			"JOBSWORTH_DEPLOY_RECORD": string(recordJSON),
+		},
+	}, nil
+}
+
+// skippedDeploysAnnotationStep returns a step that explains, in an
+// annotation on the build, why deploys to some environments were skipped.
+func skippedDeploysAnnotationStep(context *Context) (Step, error) {
+	envNames := make([]string, 0, len(context.SkipDeployEnvironments))
+	for envName := range context.SkipDeployEnvironments {
+		envNames = append(envNames, envName)
+	}
+	sort.Strings(envNames)
+
+	var annotation strings.Builder
+	annotation.WriteString("Skipped deploys to environments already running this commit:\n\n")
+	for _, envName := range envNames {
+		fmt.Fprintf(&annotation, "* %s\n", context.SkipDeployEnvironments[envName])
+	}
+
+	step := Step{
+		"name": "Skipped deploys",
+		"command": "buildkite-agent annotate --style info " +
+			"--context jobsworth-skipped-deploys \"$$$$JOBSWORTH_ANNOTATION\"",
+		"env": map[interface{}]interface{}{
+			"JOBSWORTH_ANNOTATION": annotation.String(),
+		},
+	}
+	stepContext := &StepContext{
+		EnvironmentName: context.BuildEnvironment,
+		QueueName:       "plan_pipeline",
+		EmojiName:       "fast_forward",
+	}
+	return lowerStep(step, context, stepContext)
+}
+
+// ReadLastDeploy returns the most recent deploy record for an environment,
+// by the given service if not empty, or nil if there isn't one.
+func (b *Buildkite) ReadLastDeploy(serviceName, environmentName string) (*DeployRecord, error) {
+	entries, err := b.ReadDeployHistory(serviceName, environmentName, 1)
+	if err != nil || len(entries) == 0 {
+		return nil, err
+	}
+	return &entries[0].DeployRecord, nil
+}
+
+// ReadDeployHistory returns the most recent deploy records for an
+// environment, by the given service if not empty, newest first.
+func (b *Buildkite) ReadDeployHistory(serviceName, environmentName string, limit int) ([]DeployHistoryEntry, error) {
+	key := deployHistoryMetadataKey(serviceName, environmentName)
+	var entries []DeployHistoryEntry
+
+	for page := 1; page <= maxBuildPages; page++ {
+		query := url.Values{}
+		query.Set("page", strconv.Itoa(page))
+		query.Set("per_page", "100")
+		builds, err := b.apiGETList([]string{"pipelines", b.pipelineSlug, "builds"}, query)
+		if err != nil {
+			return nil, err
+		}
+		if len(builds) == 0 {
+			break
+		}
+
+		for _, rawBuild := range builds {
+			build, ok := rawBuild.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			metaData, _ := build["meta_data"].(map[string]interface{})
+			recordJSON, ok := metaData[key].(string)
+			if !ok {
+				continue
+			}
+			entry := DeployHistoryEntry{}
+			if err := json.Unmarshal([]byte(recordJSON), &entry.DeployRecord); err != nil {
+				return nil, fmt.Errorf(
+					"build #%v has an invalid %s: %s", build["number"], key, err,
+				)
+			}
+			entry.BuildState, _ = build["state"].(string)
+			entry.FinishedAt, _ = build["finished_at"].(string)
+			entries = append(entries, entry)
+			if len(entries) >= limit {
+				return entries, nil
+			}
+		}
+	}
+
+	return entries, nil
+}
+
+// historyCommand implements "jobsworth history <environment>", returning
+// the exit status.
+func historyCommand(args []string) int {
+	flags := flag.NewFlagSet("history", flag.ExitOnError)
+	limit := flags.Int("limit", 10, "the maximum number of deploys to show")
+	serviceName := flags.String("service", "", "the service whose deploys to show, for pipelines with services")
+	organizationSlug := flags.String(
+		"organization", os.Getenv("BUILDKITE_ORGANIZATION_SLUG"),
+		"the Buildkite organization slug",
+	)
+	pipelineSlug := flags.String(
+		"pipeline", os.Getenv("BUILDKITE_PIPELINE_SLUG"),
+		"the Buildkite pipeline slug",
+	)
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "Usage: jobsworth history [options] <environment>\n\n")
+		flags.PrintDefaults()
+		return 1
+	}
+	environmentName := flags.Arg(0)
+
+	context := &Context{
+		BuildkiteAPIAccessToken:   os.Getenv("JOBSWORTH_BUILDKITE_API_TOKEN"),
+		BuildkiteOrganizationSlug: *organizationSlug,
+		BuildkitePipelineSlug:     *pipelineSlug,
+	}
+	if context.BuildkiteAPIAccessToken == "" {
+		fmt.Fprintf(os.Stderr, "JOBSWORTH_BUILDKITE_API_TOKEN environment variable not set\n")
+		return 1
+	}
+	if context.BuildkiteOrganizationSlug == "" || context.BuildkitePipelineSlug == "" {
+		fmt.Fprintf(os.Stderr, "Buildkite organization and pipeline slugs are required\n")
+		return 1
+	}
+
+	entries, err := context.Buildkite().ReadDeployHistory(*serviceName, environmentName, *limit)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading deploy history: %s\n", err)
+		return 2
+	}
+	if len(entries) == 0 {
+		fmt.Printf("No recorded deploys to %s\n", deployTarget{*serviceName, environmentName})
+		return 0
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "BUILD\tSTATE\tFINISHED\tBRANCH\tCODE VERSION\tCOMMIT\n")
+	for _, entry := range entries {
+		fmt.Fprintf(
+			w, "#%d\t%s\t%s\t%s\t%s\t%s\n",
+			entry.BuildNumber, entry.BuildState, entry.FinishedAt,
+			entry.Branch, entry.CodeVersion, entry.SourceCommitId,
+		)
+	}
+	w.Flush()
+	return 0
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/go-test/deep"
+)
+
+func TestReadDeployHistory(t *testing.T) {
+	buildkite := testBuildkiteAPI(t, `[
+		{"number": 12, "state": "passed", "finished_at": "2023-01-03T00:00:00Z", "meta_data": {
+			"jobsworth:deployed:QA": "{\"environment\":\"QA\",\"build_number\":12,\"code_version\":\"v3\",\"source_commit_id\":\"ccc\"}"
+		}},
+		{"number": 11, "state": "failed", "finished_at": "2023-01-02T00:00:00Z", "meta_data": {}},
+		{"number": 10, "state": "passed", "finished_at": "2023-01-01T00:00:00Z", "meta_data": {
+			"jobsworth:deployed:PROD": "{\"environment\":\"PROD\",\"build_number\":10,\"code_version\":\"v2\",\"source_commit_id\":\"bbb\"}"
+		}}
+	]`, `[
+		{"number": 9, "state": "passed", "finished_at": "2022-12-31T00:00:00Z", "meta_data": {
+			"jobsworth:deployed:PROD": "{\"environment\":\"PROD\",\"build_number\":9,\"code_version\":\"v1\",\"source_commit_id\":\"aaa\"}"
+		}}
+	]`)
+
+	entries, err := buildkite.ReadDeployHistory("", "PROD", 10)
+	if err != nil {
+		t.Fatal("ReadDeployHistory returned err:", err)
+	}
+	expected := []DeployHistoryEntry{
+		{
+			DeployRecord: DeployRecord{Environment: "PROD", BuildNumber: 10, CodeVersion: "v2", SourceCommitId: "bbb"},
+			BuildState:   "passed",
+			FinishedAt:   "2023-01-01T00:00:00Z",
+		},
+		{
+			DeployRecord: DeployRecord{Environment: "PROD", BuildNumber: 9, CodeVersion: "v1", SourceCommitId: "aaa"},
+			BuildState:   "passed",
+			FinishedAt:   "2022-12-31T00:00:00Z",
+		},
+	}
+	if diff := deep.Equal(expected, entries); diff != nil {
+		t.Error(diff)
+	}
+
+	entries, err = buildkite.ReadDeployHistory("", "PROD", 1)
+	if err != nil {
+		t.Fatal("ReadDeployHistory returned err:", err)
+	}
+	if len(entries) != 1 || entries[0].BuildNumber != 10 {
+		t.Error("limit should return only the most recent deploy", entries)
+	}
+}
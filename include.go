@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// includeList is the value of a pipeline's include key, which may be
+// either a single filename or a list of them.
+type includeList []string
+
+func (l *includeList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var single string
+	if err := unmarshal(&single); err == nil {
+		*l = includeList{single}
+		return nil
+	}
+	var list []string
+	if err := unmarshal(&list); err != nil {
+		return err
+	}
+	*l = list
+	return nil
+}
+
+// loadPipelineYAML reads a pipeline file as generic YAML, with the files
+// that it includes merged into it. stack holds the files that are
+// including this one, so that cycles can be detected.
+//
+// Included files are merged in the order they are listed, so later
+// includes take precedence over earlier ones, and the including file takes
+// precedence over all of them. Mappings, like phases and environments, are
+// merged key by key, while lists and other values are replaced.
+func loadPipelineYAML(fn string, stack []string) (map[interface{}]interface{}, error) {
+	absFn, err := filepath.Abs(fn)
+	if err != nil {
+		return nil, err
+	}
+	for i, includer := range stack {
+		absIncluder, _ := filepath.Abs(includer)
+		if absIncluder == absFn {
+			cycle := append(append([]string{}, stack[i:]...), fn)
+			return nil, fmt.Errorf("include cycle: %s", strings.Join(cycle, " -> "))
+		}
+	}
+
+	configBytes, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	raw := map[interface{}]interface{}{}
+	if err := yaml.Unmarshal(configBytes, &raw); err != nil {
+		return nil, fmt.Errorf("parse error: %s", err)
+	}
+	// The merged configuration is parsed from YAML generated from it,
+	// whose line numbers don't match any file, so each file is parsed on
+	// its own first to report errors with its own line numbers.
+	if err := yaml.Unmarshal(configBytes, &Pipeline{}); err != nil {
+		return nil, fmt.Errorf("parse error: %s", err)
+	}
+
+	includes, err := pipelineIncludes(raw)
+	if err != nil {
+		return nil, err
+	}
+	delete(raw, "include")
+
+	merged := map[interface{}]interface{}{}
+	for _, include := range includes {
+		includeFn := include
+		if !filepath.IsAbs(includeFn) {
+			includeFn = filepath.Join(filepath.Dir(fn), includeFn)
+		}
+		included, err := loadPipelineYAML(includeFn, append(stack, fn))
+		if err != nil {
+			return nil, fmt.Errorf("include %s: %s", include, err)
+		}
+		merged = mergeYAML(merged, included).(map[interface{}]interface{})
+	}
+	return mergeYAML(merged, raw).(map[interface{}]interface{}), nil
+}
+
+// pipelineIncludes returns the filenames listed in the include key of a
+// pipeline file parsed as generic YAML.
+func pipelineIncludes(raw map[interface{}]interface{}) ([]string, error) {
+	switch include := raw["include"].(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{include}, nil
+	case []interface{}:
+		includes := make([]string, len(include))
+		for i, item := range include {
+			fn, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("include must be a filename or a list of filenames")
+			}
+			includes[i] = fn
+		}
+		return includes, nil
+	default:
+		return nil, fmt.Errorf("include must be a filename or a list of filenames")
+	}
+}
+
+// mergeYAML merges two generic YAML values, with the second taking
+// precedence. Mappings are merged recursively, and an empty value never
+// replaces a value that has been set, so that an environment can be
+// listed without discarding the configuration it was given elsewhere.
+func mergeYAML(base, override interface{}) interface{} {
+	if override == nil {
+		return base
+	}
+	baseMap, baseIsMap := base.(map[interface{}]interface{})
+	overrideMap, overrideIsMap := override.(map[interface{}]interface{})
+	if !baseIsMap || !overrideIsMap {
+		return override
+	}
+	merged := make(map[interface{}]interface{}, len(baseMap)+len(overrideMap))
+	for k, v := range baseMap {
+		merged[k] = v
+	}
+	for k, v := range overrideMap {
+		merged[k] = mergeYAML(merged[k], v)
+	}
+	return merged
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/go-test/deep"
+)
+
+func TestMergeYAML(t *testing.T) {
+	base := map[interface{}]interface{}{
+		"deploy": []interface{}{"make deploy"},
+		"environments": map[interface{}]interface{}{
+			"qa": nil,
+			"prod": map[interface{}]interface{}{
+				"after":    []interface{}{"qa"},
+				"cautious": true,
+			},
+		},
+	}
+	override := map[interface{}]interface{}{
+		"deploy": []interface{}{"make deploy-service"},
+		"environments": map[interface{}]interface{}{
+			"prod": map[interface{}]interface{}{
+				"after": []interface{}{"staging"},
+			},
+			"staging": nil,
+		},
+	}
+	expected := map[interface{}]interface{}{
+		"deploy": []interface{}{"make deploy-service"},
+		"environments": map[interface{}]interface{}{
+			"qa": nil,
+			"prod": map[interface{}]interface{}{
+				"after":    []interface{}{"staging"},
+				"cautious": true,
+			},
+			"staging": nil,
+		},
+	}
+	if diff := deep.Equal(expected, mergeYAML(base, override)); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestIncludeCycle(t *testing.T) {
+	_, err := LoadPipelineFromFile("testdata/include/cycle_a.yml")
+	expected := "include cycle_b.yml: include cycle_a.yml: include cycle: " +
+		"testdata/include/cycle_a.yml -> testdata/include/cycle_b.yml -> testdata/include/cycle_a.yml"
+	if err == nil || err.Error() != expected {
+		t.Errorf("expected %q, got %v", expected, err)
+	}
+
+	problems, err := ValidatePipelineFile("testdata/include/cycle_a.yml")
+	if err != nil {
+		t.Fatal("ValidatePipelineFile returned err:", err)
+	}
+	if len(problems) != 1 || problems[0].Line != 1 {
+		t.Error("expected the cycle to be reported on the include line, got", problems)
+	}
+}
+
+func TestValidateIncludedFile(t *testing.T) {
+	problems, err := ValidatePipelineFile("testdata/include/invalid.yml")
+	if err != nil {
+		t.Fatal("ValidatePipelineFile returned err:", err)
+	}
+	actual := make([]string, len(problems))
+	for i, problem := range problems {
+		actual[i] = problem.String()
+	}
+	expected := []string{
+		`testdata/include/invalid.yml:4: deploy step 0: unknown variable enviroment`,
+		`testdata/include/invalid_common.yml:4: unknown key "cautous" in environment (did you mean "cautious"?)`,
+	}
+	if diff := deep.Equal(expected, actual); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestIncludeParseErrorLine(t *testing.T) {
+	_, err := LoadPipelineFromFile("testdata/include/type_error.yml")
+	expected := "parse error: yaml: unmarshal errors:\n  line 6: cannot unmarshal !!str `dev` into []string"
+	if err == nil || err.Error() != expected {
+		t.Errorf("expected %q, got %v", expected, err)
+	}
+}
@@ -3,17 +3,27 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io"
 	"os"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/libgit2/git2go/v34"
 	"gopkg.in/yaml.v2"
 )
 
 var rollbackMessageRegexp = regexp.MustCompile("^[Rr]oll\\s*back\\s+(to\\s+)?#?(\\d+)")
-var envOverrideMessageRegexp = regexp.MustCompile("^[Dd]eploy\\s*(#?(\\d+)\\s*)?(to\\s+)?(\\S+)")
+var rollbackEnvMessageRegexp = regexp.MustCompile("^[Rr]oll\\s*back\\s+(?:to\\s+)?(\\S+)")
+var envOverrideMessageRegexp = regexp.MustCompile("^([Ff]orce\\s+)?[Dd]eploy\\s*(#?(\\d+)\\s*)?(to\\s+)?(" + envListPattern + ")")
+var freezeOverrideMessageRegexp = regexp.MustCompile("^([Ff]orce\\s+)?[Dd]eploy\\s*(#?(\\d+)\\s*)?(to\\s+)?(" + envListPattern + ")\\s+despite\\s+(?:the\\s+)?freeze\\s*:\\s*(\\S.*)")
+
+// envListPattern matches a list of environment names in a build message,
+// like "QA", "QA and STAGE" or "QA, STAGE and LOADTEST".
+const envListPattern = "[^\\s,]+(?:\\s*,\\s*(?:and\\s+)?[^\\s,]+|\\s+and\\s+[^\\s,]+)*"
+
+var envListSeparatorRegexp = regexp.MustCompile("\\s*,\\s*(?:and\\s+)?|\\s+and\\s+")
 
 // variables that will be set at link time (see .goreleaser.yaml)
 var version string = "development"
@@ -25,6 +35,23 @@ const bkWait = "wait"
 
 func main() {
 	var err error
+
+	// Subcommands are handled separately, each with their own flags.
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "history":
+			os.Exit(historyCommand(os.Args[2:]))
+		case "validate":
+			os.Exit(validateCommand(os.Args[2:]))
+		case "render":
+			os.Exit(renderCommand(os.Args[2:]))
+		case "diff":
+			os.Exit(diffCommand(os.Args[2:]))
+		case "graph":
+			os.Exit(graphCommand(os.Args[2:]))
+		}
+	}
+
 	dryRun := flag.Bool("dry-run", false, "print the steps and metadata instead of uploading to BuildKite")
 	versionFlag := flag.Bool("version", false, "print the version and exit")
 	flag.Parse()
@@ -39,7 +66,12 @@ func main() {
 	}
 
 	if len(args) != 1 {
-		fmt.Fprintf(os.Stderr, "Usage: jobsworth <pipeline-file>\n\n")
+		fmt.Fprintf(os.Stderr, "Usage: jobsworth <pipeline-file>\n")
+		fmt.Fprintf(os.Stderr, "       jobsworth validate <pipeline-file>\n")
+		fmt.Fprintf(os.Stderr, "       jobsworth render [options] <pipeline-file>\n")
+		fmt.Fprintf(os.Stderr, "       jobsworth diff [options] <old-pipeline-file> [<new-pipeline-file>]\n")
+		fmt.Fprintf(os.Stderr, "       jobsworth graph [options] <pipeline-file>\n")
+		fmt.Fprintf(os.Stderr, "       jobsworth history [options] <environment>\n\n")
 		os.Exit(1)
 	}
 
@@ -53,7 +85,9 @@ func main() {
 	context := &Context{
 		ConfigFilename:            args[0],
 		BranchName:                os.Getenv("BUILDKITE_BRANCH"),
+		TagName:                   os.Getenv("BUILDKITE_TAG"),
 		BuildMessage:              os.Getenv("BUILDKITE_MESSAGE"),
+		DefaultBranch:             os.Getenv("BUILDKITE_PIPELINE_DEFAULT_BRANCH"),
 		RepoURL:                   os.Getenv("BUILDKITE_REPO"),
 		BuildEnvironment:          os.Getenv("JOBSWORTH_ENVIRONMENT"),
 		BuildkiteJobId:            os.Getenv("BUILDKITE_JOB_ID"),
@@ -63,9 +97,14 @@ func main() {
 		BuildkiteAPIAccessToken:   os.Getenv("JOBSWORTH_BUILDKITE_API_TOKEN"),
 		BuildkitePipelineSlug:     os.Getenv("BUILDKITE_PIPELINE_SLUG"),
 		BuildkiteOrganizationSlug: os.Getenv("BUILDKITE_ORGANIZATION_SLUG"),
+		BuildTime:                 time.Now(),
 	}
-	if os.Getenv("BUILDKITE_PULL_REQUEST") != "false" {
+	// BUILDKITE_PULL_REQUEST is the pull request number, or "false" for
+	// builds that are not for a pull request.
+	if pullRequest := os.Getenv("BUILDKITE_PULL_REQUEST"); pullRequest != "" && pullRequest != "false" {
 		context.InPullRequest = true
+		context.PullRequestNumber = pullRequest
+		context.PullRequestBaseBranch = os.Getenv("BUILDKITE_PULL_REQUEST_BASE_BRANCH")
 	}
 	if buildNumberString := os.Getenv("BUILDKITE_BUILD_NUMBER"); buildNumberString != "" {
 		context.BuildNumber, err = strconv.ParseUint(
@@ -118,14 +157,14 @@ func main() {
 func run(context *Context, dryRun bool) error {
 	if dryRun {
 		buildkite := DryRunBuildMetadataClient{}
-		bkSteps, writeMetadata, err := generateSteps(context, &buildkite)
+		bkSteps, writeMetadata, err := generateSteps(context, &buildkite, os.Stdout)
 		if err != nil {
 			return err
 		}
 		return printSteps(bkSteps, writeMetadata)
 	} else {
 		buildkite := context.Buildkite()
-		bkSteps, writeMetadata, err := generateSteps(context, buildkite)
+		bkSteps, writeMetadata, err := generateSteps(context, buildkite, os.Stdout)
 		if err != nil {
 			return err
 		}
@@ -133,16 +172,117 @@ func run(context *Context, dryRun bool) error {
 	}
 }
 
-func generateSteps(context *Context, buildkite BuildMetadataClient) (
+func generateSteps(context *Context, buildkite BuildMetadataClient, out io.Writer) (
 	[]interface{}, map[string]string, error) {
+	pipeline, writeMetadata, err := preparePipeline(context, buildkite, out)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	bkSteps, err := pipeline.Lower(context)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error lowering pipeline: %s", err)
+	}
+
+	writeMetadata["jobsworth:code_version"] = context.CodeVersion
+	writeMetadata["jobsworth:source_commit_id"] = context.SourceGitCommitId
+	return bkSteps, writeMetadata, nil
+}
+
+// preparePipeline loads the pipeline and finishes preparing the context
+// for lowering it, reading whatever it needs from earlier builds. It
+// returns the pipeline along with the metadata to copy to this build.
+func preparePipeline(context *Context, buildkite BuildMetadataClient, out io.Writer) (
+	*Pipeline, map[string]string, error) {
 	pipeline, err := LoadPipelineFromFile(context.ConfigFilename)
 	if err != nil {
 		return nil, nil, fmt.Errorf("Error parsing pipeline: %s", err)
 	}
 	writeMetadata := map[string]string{}
+
+	if pipeline.CodeVersionFormat != "" {
+		context.CodeVersion, err = context.FormatCodeVersion(pipeline.CodeVersionFormat)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Error formatting code version: %s", err)
+		}
+	}
+
+	if context.TagName != "" {
+		tagRule, err := pipeline.tagRule(context.TagName)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Error selecting tag rule: %s", err)
+		}
+		if tagRule != nil && tagRule.CodeVersionFromTag {
+			fmt.Fprintf(out, "Using tag %s as the code version\n", context.TagName)
+			context.CodeVersion = context.TagName
+		}
+	}
+
+	if err := findBuildOverrides(context, pipeline, buildkite, out); err != nil {
+		return nil, nil, err
+	}
+
+	// "Roll back" is followed by an environment name only if it's one the
+	// build message could deploy to. Otherwise it's an ordinary message,
+	// like "Rollback the logging change".
+	if context.RollbackEnvironmentName != "" {
+		known, err := pipeline.isOverrideEnvironment(context.RollbackEnvironmentName)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !known {
+			context.RollbackEnvironmentName = ""
+			context.OverrideDeployEnvironmentNames = nil
+		}
+	}
+
+	// The environments named by the build message are only checked, and
+	// a rollback only looked up, if the build deploys, since on other
+	// branches it could be any message that starts with "Deploy".
+	deploys := false
+	if len(context.OverrideDeployEnvironmentNames) > 0 {
+		context.OverrideDeployEnvironmentNames, err = pipeline.trimOverrideEnvironments(
+			context.OverrideDeployEnvironmentNames, context.ForceOverrideEnvironments,
+		)
+		if err != nil {
+			return nil, nil, err
+		}
+		deployEnvNames, err := pipeline.DeployEnvironmentNames(context)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Error lowering pipeline: %s", err)
+		}
+		deploys = len(deployEnvNames) > 0
+		if deploys {
+			err := pipeline.checkOverrideEnvironments(
+				context.OverrideDeployEnvironmentNames, context.ForceOverrideEnvironments,
+			)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	if context.RollbackEnvironmentName != "" && deploys {
+		agentEnvironment := pipeline.agentEnvironmentTag(context.RollbackEnvironmentName)
+		buildNumber, err := buildkite.FindPreviousGoodDeploy(
+			context.RollbackEnvironmentName, agentEnvironment, context.BuildNumber,
+		)
+		if err != nil {
+			return nil, nil, fmt.Errorf(
+				"error finding previous deploy to %s: %s",
+				context.RollbackEnvironmentName, err,
+			)
+		}
+		fmt.Fprintf(
+			out, "Rolling back %s to its previous deploy from build #%s\n",
+			context.RollbackEnvironmentName, buildNumber,
+		)
+		context.ArtifactsFromBuildNumber = buildNumber
+	}
+
 	if context.ArtifactsFromBuildNumber != "" {
-		fmt.Printf(
-			"Re-using artifacts from build #%s\n",
+		fmt.Fprintf(
+			out, "Re-using artifacts from build #%s\n",
 			context.ArtifactsFromBuildNumber,
 		)
 		// Copy all the non-deployment-related metadata from
@@ -189,21 +329,104 @@ func generateSteps(context *Context, buildkite BuildMetadataClient) (
 		}
 	}
 
-	if context.OverrideDeployEnvironmentName != "" {
-		fmt.Printf(
-			"Forcing deployment to non-standard environment %s\n",
-			context.OverrideDeployEnvironmentName,
+	// Re-deploying earlier artifacts isn't affected by what this commit
+	// changes.
+	if context.ArtifactsFromBuildNumber == "" && pipeline.usesPaths() {
+		if !context.ChangedPathsKnown && context.InGitRepository {
+			err := findChangedPaths(context, pipeline, buildkite, out)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		reportUnchangedPaths(context, pipeline, out)
+	} else {
+		context.ChangedPathsKnown = false
+	}
+
+	if len(context.OverrideDeployEnvironmentNames) > 0 {
+		fmt.Fprintf(
+			out, "Forcing deployment to non-standard environments %s\n",
+			strings.Join(context.OverrideDeployEnvironmentNames, ", "),
 		)
 	}
 
-	bkSteps, err := pipeline.Lower(context)
+	if pipeline.SkipIfAlreadyDeployed {
+		err := findAlreadyDeployed(context, pipeline, buildkite, out)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if context.FreezeOverrideReason != "" {
+		fmt.Fprintf(
+			out, "Deploying to %s despite any freeze: %s\n",
+			strings.Join(context.OverrideDeployEnvironmentNames, ", "), context.FreezeOverrideReason,
+		)
+		writeMetadata["jobsworth:freeze_override_reason"] = context.FreezeOverrideReason
+	} else if len(pipeline.Freeze) > 0 {
+		err := findFrozen(context, pipeline, out)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return pipeline, writeMetadata, nil
+}
+
+// findAlreadyDeployed marks each of the environments that the build would
+// deploy to as skipped if its last recorded deploy was of the same commit.
+// With services, each service's deploys are considered separately.
+func findAlreadyDeployed(context *Context, pipeline *Pipeline, buildkite BuildMetadataClient, out io.Writer) error {
+	targets, err := pipeline.deployTargets(context)
 	if err != nil {
-		return nil, nil, fmt.Errorf("Error lowering pipeline: %s", err)
+		return fmt.Errorf("Error lowering pipeline: %s", err)
 	}
+	for _, target := range targets {
+		lastDeploy, err := buildkite.ReadLastDeploy(target.service, target.environment)
+		if err != nil {
+			return fmt.Errorf("error reading last deploy to %s: %s", target, err)
+		}
+		if lastDeploy == nil || lastDeploy.SourceCommitId != context.SourceGitCommitId {
+			continue
+		}
+		reason := fmt.Sprintf(
+			"%s is already running %s (commit %s) from build #%d",
+			target, lastDeploy.CodeVersion, lastDeploy.SourceCommitId,
+			lastDeploy.BuildNumber,
+		)
+		fmt.Fprintf(out, "Skipping deploy: %s\n", reason)
+		if target.service == "" {
+			if context.SkipDeployEnvironments == nil {
+				context.SkipDeployEnvironments = map[string]string{}
+			}
+			context.SkipDeployEnvironments[target.environment] = reason
+			continue
+		}
+		if context.ServiceSkipDeployEnvironments == nil {
+			context.ServiceSkipDeployEnvironments = map[string]map[string]string{}
+		}
+		if context.ServiceSkipDeployEnvironments[target.service] == nil {
+			context.ServiceSkipDeployEnvironments[target.service] = map[string]string{}
+		}
+		context.ServiceSkipDeployEnvironments[target.service][target.environment] = reason
+	}
+	return nil
+}
 
-	writeMetadata["jobsworth:code_version"] = context.CodeVersion
-	writeMetadata["jobsworth:source_commit_id"] = context.SourceGitCommitId
-	return bkSteps, writeMetadata, nil
+// findFrozen marks each of the environments that the build would deploy
+// to as frozen if a freeze window applies to it at the time of the build.
+func findFrozen(context *Context, pipeline *Pipeline, out io.Writer) error {
+	envNames, err := pipeline.DeployEnvironmentNames(context)
+	if err != nil {
+		return fmt.Errorf("Error lowering pipeline: %s", err)
+	}
+	context.FrozenEnvironments = pipeline.frozenEnvironments(context, envNames)
+	for _, envName := range envNames {
+		if window := context.FrozenEnvironments[envName]; window != nil {
+			fmt.Fprintf(out, "Not deploying to %s: frozen by %s\n", envName, window)
+		}
+	}
+	return nil
 }
 
 func printSteps(bkSteps []interface{}, writeMetadata map[string]string) error {
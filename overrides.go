@@ -0,0 +1,319 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/libgit2/git2go/v34"
+)
+
+// BuildOverrides adjust what a single build runs. They are given as
+// trailers on the commit being built, like "Jobsworth-Skip: validation_test",
+// or as metadata on the build when it is triggered, like
+// "jobsworth:skip=validation_test". Build metadata takes precedence over
+// commit trailers.
+type BuildOverrides struct {
+	// SkipPhases are the names of phases that don't run.
+	SkipPhases []string
+	// Environments, if not nil, limits the deploy to the named
+	// environments.
+	Environments []string
+
+	// sources describes where each override was given, by its name.
+	sources map[string]string
+}
+
+// buildOverrideKeys are the commit trailer and build metadata keys that
+// each override is given with, by its name.
+var buildOverrideKeys = []struct {
+	name     string
+	trailer  string
+	metadata string
+}{
+	{"skip", "Jobsworth-Skip", "jobsworth:skip"},
+	{"environments", "Jobsworth-Environments", "jobsworth:environments"},
+}
+
+// set sets the named override from a comma-separated list.
+func (o *BuildOverrides) set(name, value, source string) {
+	values := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			values = append(values, item)
+		}
+	}
+	switch name {
+	case "skip":
+		o.SkipPhases = values
+	case "environments":
+		o.Environments = values
+	}
+	if o.sources == nil {
+		o.sources = map[string]string{}
+	}
+	o.sources[name] = source
+}
+
+// skipsPhase returns true if the named phase is skipped.
+func (o *BuildOverrides) skipsPhase(name string) bool {
+	for _, skipped := range o.SkipPhases {
+		if skipped == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Summary describes the overrides and where they came from, one per line.
+func (o *BuildOverrides) Summary() []string {
+	var lines []string
+	for _, keys := range buildOverrideKeys {
+		source, ok := o.sources[keys.name]
+		if !ok {
+			continue
+		}
+		values := o.SkipPhases
+		if keys.name == "environments" {
+			values = o.Environments
+		}
+		description := strings.Join(values, ", ")
+		if description == "" {
+			description = "(none)"
+		}
+		lines = append(lines, fmt.Sprintf("%s: %s (from %s)", keys.name, description, source))
+	}
+	return lines
+}
+
+// newBuildOverrides combines the overrides given as commit trailers and
+// as build metadata.
+func newBuildOverrides(trailers, metadata map[string]string) BuildOverrides {
+	overrides := BuildOverrides{}
+	trailerKeys := make([]string, 0, len(trailers))
+	for trailerKey := range trailers {
+		trailerKeys = append(trailerKeys, trailerKey)
+	}
+	sort.Strings(trailerKeys)
+
+	for _, keys := range buildOverrideKeys {
+		// Trailer keys aren't case sensitive.
+		for _, trailerKey := range trailerKeys {
+			if strings.EqualFold(trailerKey, keys.trailer) {
+				overrides.set(keys.name, trailers[trailerKey], fmt.Sprintf("commit trailer %s", keys.trailer))
+			}
+		}
+		if value, ok := metadata[keys.metadata]; ok {
+			overrides.set(keys.name, value, fmt.Sprintf("build metadata %s", keys.metadata))
+		}
+	}
+	return overrides
+}
+
+// commitTrailers returns the trailers at the end of a commit message, like
+// "Jobsworth-Skip: validation_test". Trailers given more than once have
+// their values joined with commas.
+func commitTrailers(message string) map[string]string {
+	trailers := map[string]string{}
+	parsed, err := git.MessageTrailers(message)
+	if err != nil {
+		return trailers
+	}
+	for _, trailer := range parsed {
+		if existing, ok := trailers[trailer.Key]; ok {
+			trailers[trailer.Key] = existing + "," + trailer.Value
+		} else {
+			trailers[trailer.Key] = trailer.Value
+		}
+	}
+	return trailers
+}
+
+// findBuildOverrides records in the context the overrides given for the
+// build, checking that they only name phases and environments that exist.
+func findBuildOverrides(context *Context, pipeline *Pipeline, buildkite BuildMetadataClient, out io.Writer) error {
+	metadata := context.BuildMetadata
+	if metadata == nil && context.BuildNumber != 0 {
+		var err error
+		metadata, err = buildkite.ReadOtherBuildMetadata(strconv.FormatUint(context.BuildNumber, 10))
+		if err != nil {
+			return fmt.Errorf("error reading build metadata: %s", err)
+		}
+	}
+
+	overrides := newBuildOverrides(context.CommitTrailers, metadata)
+	if err := pipeline.checkOverrides(&overrides); err != nil {
+		return err
+	}
+	context.Overrides = overrides
+	for _, line := range overrides.Summary() {
+		fmt.Fprintf(out, "Override %s\n", line)
+	}
+	return nil
+}
+
+// checkOverrides checks that the overrides only name phases and
+// environments that are declared by the pipeline or one of its services.
+func (p *Pipeline) checkOverrides(overrides *BuildOverrides) error {
+	phaseNames := map[string]bool{}
+	for _, pipeline := range p.withServices() {
+		globalPhases, envPhases, err := pipeline.orderedPhases()
+		if err != nil {
+			return err
+		}
+		for _, phase := range append(globalPhases, envPhases...) {
+			phaseNames[phase.name] = true
+		}
+	}
+	for _, name := range overrides.SkipPhases {
+		if !phaseNames[name] {
+			return fmt.Errorf("%s names unknown phase %s", overrides.sources["skip"], name)
+		}
+	}
+
+	envNames, err := p.declaredEnvironmentNames()
+	if err != nil {
+		return err
+	}
+	for _, name := range overrides.Environments {
+		if !envNames[name] {
+			return fmt.Errorf(
+				"%s names unknown environment %s (expected one of %s)",
+				overrides.sources["environments"], name, joinNames(envNames),
+			)
+		}
+	}
+	return nil
+}
+
+// checkOverrideEnvironments checks that the environments named by the
+// build message are declared by the pipeline or one of its services, or
+// match one of their adhoc_environments. A forced deploy can name any
+// environment unless adhoc_environments is given.
+func (p *Pipeline) checkOverrideEnvironments(names []string, force bool) error {
+	envNames, err := p.declaredEnvironmentNames()
+	if err != nil {
+		return err
+	}
+	patterns := p.adhocEnvironmentPatterns()
+	if force && len(patterns) == 0 {
+		return nil
+	}
+
+	for _, name := range names {
+		if envNames[name] || matchAnyPattern(patterns, name) {
+			continue
+		}
+		if len(patterns) == 0 {
+			return fmt.Errorf(
+				"build message names unknown environment %s (expected one of %s); "+
+					"start the message with \"Force deploy\" to deploy to it anyway",
+				name, joinNames(envNames),
+			)
+		}
+		return fmt.Errorf(
+			"build message names unknown environment %s (expected one of %s, "+
+				"or a name matching adhoc_environments %s)",
+			name, joinNames(envNames), strings.Join(patterns, ", "),
+		)
+	}
+	return nil
+}
+
+// isOverrideEnvironment returns true if the name is declared by the
+// pipeline or one of its services, or matches one of their
+// adhoc_environments.
+func (p *Pipeline) isOverrideEnvironment(name string) (bool, error) {
+	envNames, err := p.declaredEnvironmentNames()
+	if err != nil {
+		return false, err
+	}
+	return envNames[name] || matchAnyPattern(p.adhocEnvironmentPatterns(), name), nil
+}
+
+// trimOverrideEnvironments drops the names from the end of a list given in
+// a build message once one of them isn't an environment that can be
+// deployed to, since the list is usually followed by the rest of the
+// message, as in "Deploy to qa and then run the smoke tests". The first
+// name is always kept, as is every name for a forced deploy unless
+// adhoc_environments is given.
+func (p *Pipeline) trimOverrideEnvironments(names []string, force bool) ([]string, error) {
+	envNames, err := p.declaredEnvironmentNames()
+	if err != nil {
+		return nil, err
+	}
+	patterns := p.adhocEnvironmentPatterns()
+	if force && len(patterns) == 0 {
+		return names, nil
+	}
+	for i := 1; i < len(names); i++ {
+		if !envNames[names[i]] && !matchAnyPattern(patterns, names[i]) {
+			return names[:i], nil
+		}
+	}
+	return names, nil
+}
+
+// adhocEnvironmentPatterns returns the adhoc_environments patterns of the
+// pipeline and its services, without repeats.
+func (p *Pipeline) adhocEnvironmentPatterns() []string {
+	var patterns []string
+	seen := map[string]bool{}
+	for _, pipeline := range p.withServices() {
+		for _, pattern := range pipeline.AdhocEnvironments {
+			if !seen[pattern] {
+				seen[pattern] = true
+				patterns = append(patterns, pattern)
+			}
+		}
+	}
+	return patterns
+}
+
+// matchAnyPattern returns true if the name matches any of the patterns,
+// which have already been checked to be valid.
+func matchAnyPattern(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := matchPattern(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// withServices returns the pipeline followed by each of its services.
+func (p *Pipeline) withServices() []*Pipeline {
+	pipelines := []*Pipeline{p}
+	for _, name := range p.serviceNames() {
+		pipelines = append(pipelines, &p.Services[name].Pipeline)
+	}
+	return pipelines
+}
+
+// declaredEnvironmentNames returns the names of the environments declared
+// by the pipeline or any of its services.
+func (p *Pipeline) declaredEnvironmentNames() (map[string]bool, error) {
+	envNames := map[string]bool{}
+	for _, pipeline := range p.withServices() {
+		_, names, err := pipeline.environmentGraph()
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			envNames[name] = true
+		}
+	}
+	return envNames, nil
+}
+
+// joinNames lists a set of names in sorted order.
+func joinNames(names map[string]bool) string {
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	return strings.Join(sorted, ", ")
+}
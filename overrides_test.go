@@ -0,0 +1,138 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/go-test/deep"
+)
+
+func TestNewBuildOverrides(t *testing.T) {
+	overrides := newBuildOverrides(
+		map[string]string{
+			"jobsworth-skip":         "validation_test",
+			"Jobsworth-Environments": "qa, staging",
+			"Signed-off-by":          "someone",
+		},
+		map[string]string{
+			"jobsworth:environments": "prod-us",
+		},
+	)
+	if diff := deep.Equal([]string{"validation_test"}, overrides.SkipPhases); diff != nil {
+		t.Error("skip:", diff)
+	}
+	if diff := deep.Equal([]string{"prod-us"}, overrides.Environments); diff != nil {
+		t.Error("environments:", diff)
+	}
+	expected := []string{
+		"skip: validation_test (from commit trailer Jobsworth-Skip)",
+		"environments: prod-us (from build metadata jobsworth:environments)",
+	}
+	if diff := deep.Equal(expected, overrides.Summary()); diff != nil {
+		t.Error("summary:", diff)
+	}
+
+	none := newBuildOverrides(nil, nil)
+	if none.Environments != nil || len(none.Summary()) != 0 {
+		t.Errorf("expected no overrides, got %v", none.Summary())
+	}
+}
+
+func TestCommitTrailers(t *testing.T) {
+	trailers := commitTrailers(
+		"Fix the widget\n\nIt was broken.\n\nJobsworth-Skip: validation_test\nJobsworth-Skip: smoke_test\n",
+	)
+	if diff := deep.Equal("validation_test,smoke_test", trailers["Jobsworth-Skip"]); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestBuildOverrides(t *testing.T) {
+	commands := func(bkSteps []interface{}) []string {
+		var commands []string
+		for _, bkStep := range bkSteps {
+			if step, ok := bkStep.(Step); ok {
+				commands = append(commands, step["command"].(string))
+			}
+		}
+		return commands
+	}
+
+	tests := []struct {
+		trailers map[string]string
+		metadata map[string]string
+		message  string
+		commands []string
+	}{
+		{
+			map[string]string{"Jobsworth-Skip": "validation_test"},
+			nil,
+			"",
+			[]string{"deploy dev", "deploy qa", "deploy staging", "deploy prod-eu", "deploy prod-us"},
+		},
+		{
+			map[string]string{"Jobsworth-Environments": "dev,prod-us"},
+			nil,
+			"",
+			[]string{"deploy dev", "integrationtest", "deploy prod-us", "integrationtest"},
+		},
+		{
+			map[string]string{"Jobsworth-Environments": "dev"},
+			map[string]string{"jobsworth:environments": "staging", "jobsworth:skip": ""},
+			"",
+			[]string{"deploy staging", "integrationtest"},
+		},
+		{
+			map[string]string{"Jobsworth-Environments": "dev"},
+			nil,
+			"Deploy to qa",
+			[]string{"deploy qa", "integrationtest"},
+		},
+	}
+	for _, test := range tests {
+		context := &Context{
+			ConfigFilename: "testdata/environments.in.yaml",
+			BranchName:     "master",
+			BuildMessage:   test.message,
+			CommitTrailers: test.trailers,
+			BuildMetadata:  test.metadata,
+		}
+		context.DoMessageMagic()
+		bkSteps, _, err := generateSteps(context, &DryRunBuildMetadataClient{}, io.Discard)
+		if err != nil {
+			t.Fatal("generateSteps returned err:", err)
+		}
+		if diff := deep.Equal(test.commands, commands(bkSteps)); diff != nil {
+			t.Error(test.trailers, test.metadata, diff)
+		}
+	}
+}
+
+func TestBuildOverridesUnknown(t *testing.T) {
+	tests := []struct {
+		trailers map[string]string
+		expected string
+	}{
+		{
+			map[string]string{"Jobsworth-Skip": "smoke_tests"},
+			"commit trailer Jobsworth-Skip names unknown phase smoke_tests",
+		},
+		{
+			map[string]string{"Jobsworth-Environments": "qa,production"},
+			"commit trailer Jobsworth-Environments names unknown environment production (expected one of dev, prod-eu, prod-us, qa, staging)",
+		},
+	}
+	for _, test := range tests {
+		context := &Context{
+			ConfigFilename: "testdata/environments.in.yaml",
+			BranchName:     "master",
+			CommitTrailers: test.trailers,
+			BuildMetadata:  map[string]string{},
+		}
+		_, _, err := generateSteps(context, &DryRunBuildMetadataClient{}, io.Discard)
+		if err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("expected error %q, got %v", test.expected, err)
+		}
+	}
+}
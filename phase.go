@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Phase is a named list of steps that runs at a particular point in the
+// pipeline.
+//
+// Custom phases are positioned relative to another phase, and behave like
+// the built-in phase they are ultimately positioned against: a phase
+// before "build" runs only when the build would, while a phase after
+// "validation_test" runs once for each environment.
+type Phase struct {
+	Before string `yaml:"before"`
+	After  string `yaml:"after"`
+	Queue  string `yaml:"queue"`
+	Emoji  string `yaml:"emoji"`
+	Steps  []Step `yaml:"steps"`
+
+	// Defaults are merged into each of the phase's command steps, taking
+	// precedence over the pipeline's defaults.
+	Defaults Step `yaml:"defaults"`
+
+	// Paths limits the phase to builds that change a file matching one of
+	// its globs.
+	Paths []string `yaml:"paths"`
+
+	name string
+	// builtin is the name of the built-in phase that determines when
+	// this phase runs.
+	builtin string
+	// defaults combines the pipeline's defaults with the phase's own.
+	defaults Step
+}
+
+// The built-in phases, in the order they run. The first two run once per
+// build, and the others once per deploy environment.
+var builtinPhases = []Phase{
+	{name: "smoke_test", Queue: "smoke_test", Emoji: "interrobang"},
+	{name: "build", Queue: "build", Emoji: "package"},
+	{name: "deploy", Queue: "deploy", Emoji: "truck"},
+	{name: "validation_test", Queue: "validation_test", Emoji: "curly_loop"},
+}
+
+// runs returns true if the phase has steps that run for the build, given
+// the rule chosen for it.
+func (p *Phase) runs(rule *BranchRule, context *Context) bool {
+	return len(p.Steps) > 0 && rule.RunsPhase(p) &&
+		context.changedPathsMatch(p.Paths) && !context.Overrides.skipsPhase(p.name)
+}
+
+func isPerEnvironmentPhase(builtin string) bool {
+	return builtin == "deploy" || builtin == "validation_test"
+}
+
+// orderedPhases returns the phases that run once per build and the phases
+// that run once per deploy environment, each in the order they run.
+func (p *Pipeline) orderedPhases() (global []*Phase, perEnv []*Phase, err error) {
+	builtinSteps := map[string][]Step{
+		"smoke_test":      p.SmokeTest,
+		"build":           p.Build,
+		"deploy":          p.Deploy,
+		"validation_test": p.ValidationTest,
+	}
+
+	for _, builtin := range builtinPhases {
+		phase := builtin
+		phase.builtin = phase.name
+		phase.Steps = builtinSteps[phase.name]
+
+		// Built-in phases can be customized, but not moved.
+		if custom := p.Phases[phase.name]; custom != nil {
+			if custom.Before != "" || custom.After != "" {
+				return nil, nil, fmt.Errorf(
+					"built-in phase %s cannot be repositioned", phase.name,
+				)
+			}
+			if len(custom.Steps) > 0 {
+				if len(phase.Steps) > 0 {
+					return nil, nil, fmt.Errorf(
+						"steps for phase %s are given both at the top level and under phases",
+						phase.name,
+					)
+				}
+				phase.Steps = custom.Steps
+			}
+			if custom.Queue != "" {
+				phase.Queue = custom.Queue
+			}
+			if custom.Emoji != "" {
+				phase.Emoji = custom.Emoji
+			}
+			phase.Defaults = custom.Defaults
+			phase.Paths = custom.Paths
+		}
+
+		if isPerEnvironmentPhase(phase.name) {
+			perEnv = append(perEnv, &phase)
+		} else {
+			global = append(global, &phase)
+		}
+	}
+
+	pending := make([]string, 0, len(p.Phases))
+	for name := range p.Phases {
+		if !isBuiltinPhase(name) {
+			pending = append(pending, name)
+		}
+	}
+	sort.Strings(pending)
+
+	// Custom phases may be positioned relative to one another, so we
+	// place them in as many passes as it takes for all of their anchors
+	// to have been placed.
+	for len(pending) > 0 {
+		var unplaced []string
+		for _, name := range pending {
+			custom := p.Phases[name]
+			if custom == nil {
+				custom = &Phase{}
+			}
+			anchor := custom.Before
+			if custom.Before != "" && custom.After != "" {
+				return nil, nil, fmt.Errorf(
+					"phase %s cannot have both before and after", name,
+				)
+			}
+			if anchor == "" {
+				anchor = custom.After
+			}
+			if anchor == "" {
+				return nil, nil, fmt.Errorf(
+					"phase %s must have either before or after", name,
+				)
+			}
+			if _, exists := p.Phases[anchor]; !exists && !isBuiltinPhase(anchor) {
+				return nil, nil, fmt.Errorf(
+					"phase %s is positioned relative to unknown phase %s",
+					name, anchor,
+				)
+			}
+
+			var placed bool
+			global, placed = placePhase(global, name, custom)
+			if !placed {
+				perEnv, placed = placePhase(perEnv, name, custom)
+			}
+			if !placed {
+				unplaced = append(unplaced, name)
+			}
+		}
+		if len(unplaced) == len(pending) {
+			return nil, nil, fmt.Errorf(
+				"phases %v are positioned relative to each other in a cycle",
+				unplaced,
+			)
+		}
+		pending = unplaced
+	}
+
+	for _, phase := range append(append([]*Phase{}, global...), perEnv...) {
+		phase.defaults = applyStepDefaults(p.Defaults, phase.Defaults)
+	}
+
+	return global, perEnv, nil
+}
+
+// placePhase inserts the custom phase into the given sequence next to its
+// anchor, if the anchor is present. Phases placed after the same anchor
+// keep the order in which they were placed.
+func placePhase(phases []*Phase, name string, custom *Phase) ([]*Phase, bool) {
+	for i, anchor := range phases {
+		if anchor.name != custom.Before && anchor.name != custom.After {
+			continue
+		}
+
+		phase := *custom
+		phase.name = name
+		phase.builtin = anchor.builtin
+		if phase.Queue == "" {
+			phase.Queue = name
+		}
+		if phase.Emoji == "" {
+			phase.Emoji = anchor.Emoji
+		}
+
+		pos := i
+		if custom.After != "" {
+			pos = i + 1
+			for pos < len(phases) && phases[pos].After == custom.After {
+				pos++
+			}
+		}
+
+		phases = append(phases, nil)
+		copy(phases[pos+1:], phases[pos:])
+		phases[pos] = &phase
+		return phases, true
+	}
+	return phases, false
+}
+
+func isBuiltinPhase(name string) bool {
+	for _, builtin := range builtinPhases {
+		if builtin.name == name {
+			return true
+		}
+	}
+	return false
+}
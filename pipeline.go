@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"encoding/gob"
 	"fmt"
-	"io/ioutil"
 	"strings"
 
 	"github.com/hashicorp/hil"
@@ -24,25 +23,120 @@ type Pipeline struct {
 	ValidationTest     []Step   `yaml:"validation_test"`
 	TrivialDeployEnvs  []string `yaml:"trivial_deploy_environments"`
 	CautiousDeployEnvs []string `yaml:"cautious_deploy_environments"`
+
+	Environments map[string]*Environment `yaml:"environments"`
+	Phases       map[string]*Phase       `yaml:"phases"`
+	Branches     []*BranchRule           `yaml:"branches"`
+	PullRequest  *PullRequestRule        `yaml:"pull_request"`
+	Tags         []*TagRule              `yaml:"tags"`
+	Approval     *Approval               `yaml:"approval"`
+	Freeze       []*FreezeWindow         `yaml:"freeze"`
+
+	// AdhocEnvironments are the environments besides those declared that
+	// a build message can name to deploy to, as globs or regular
+	// expressions enclosed in slashes. When it is given, even a forced
+	// deploy is limited to them.
+	AdhocEnvironments []string `yaml:"adhoc_environments"`
+
+	// Defaults are merged into every command step in the pipeline.
+	Defaults Step `yaml:"defaults"`
+
+	// Services are built in place of the pipeline's own phases, for
+	// repositories that hold several codebases.
+	Services map[string]*Service `yaml:"services"`
+
+	// Include lists other pipeline files to merge into this one. It is
+	// handled before the pipeline is parsed, by loadPipelineYAML.
+	Include includeList `yaml:"include"`
+
+	// DefaultBranch is the branch that others are merged into, which the
+	// changes made by builds of other branches are found relative to. It
+	// overrides the Buildkite pipeline's default branch.
+	DefaultBranch string `yaml:"default_branch"`
+
+	CodeVersionFormat     string `yaml:"code_version_format"`
+	RecordDeployHistory   bool   `yaml:"record_deploy_history"`
+	SkipIfAlreadyDeployed bool   `yaml:"skip_if_already_deployed"`
+	GroupSteps            bool   `yaml:"group_steps"`
+	UseDependsOn          bool   `yaml:"use_depends_on"`
 }
 
 type Step map[string]interface{}
 
 func LoadPipelineFromFile(fn string) (*Pipeline, error) {
-	configBytes, err := ioutil.ReadFile(fn)
+	raw, err := loadPipelineYAML(fn, nil)
 	if err != nil {
 		return nil, err
 	}
 
+	// The merged configuration is round-tripped through YAML to parse it
+	// into the pipeline's structure.
+	configBytes, err := yaml.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
 	pipeline := &Pipeline{}
 	err = yaml.Unmarshal(configBytes, pipeline)
 	if err != nil {
+		return nil, fmt.Errorf("parse error in the merged configuration: %s", err)
+	}
+	if err := pipeline.loadServices(raw); err != nil {
 		return nil, fmt.Errorf("parse error: %s", err)
 	}
 
+	if err := pipeline.checkSettings(); err != nil {
+		return nil, err
+	}
+	for _, name := range pipeline.serviceNames() {
+		service := pipeline.Services[name]
+		if err := service.checkSettings(); err != nil {
+			return nil, fmt.Errorf("service %s: %s", name, err)
+		}
+		if err := validatePathGlobs(service.Paths); err != nil {
+			return nil, fmt.Errorf("service %s: %s", name, err)
+		}
+	}
+
 	return pipeline, nil
 }
 
+// checkSettings checks the settings that would otherwise only fail once
+// they are used.
+func (p *Pipeline) checkSettings() error {
+	if p.CodeVersionFormat != "" {
+		if err := validateCodeVersionFormat(p.CodeVersionFormat); err != nil {
+			return fmt.Errorf("invalid code_version_format: %s", err)
+		}
+	}
+	if p.Approval != nil {
+		if err := p.Approval.validate(); err != nil {
+			return fmt.Errorf("invalid approval: %s", err)
+		}
+	}
+	for i, window := range p.Freeze {
+		if window == nil {
+			continue
+		}
+		if err := window.validate(); err != nil {
+			return fmt.Errorf("invalid freeze window %d: %s", i, err)
+		}
+	}
+	for _, pattern := range p.AdhocEnvironments {
+		if _, err := matchPattern(pattern, ""); err != nil {
+			return fmt.Errorf("adhoc environment pattern %q: %s", pattern, err)
+		}
+	}
+	for name, phase := range p.Phases {
+		if phase == nil {
+			continue
+		}
+		if err := validatePathGlobs(phase.Paths); err != nil {
+			return fmt.Errorf("phase %s: %s", name, err)
+		}
+	}
+	return nil
+}
+
 func MarshalPipelineSteps(steps []interface{}) ([]byte, error) {
 	return yaml.Marshal(map[string]interface{}{
 		"steps": steps,
@@ -56,141 +150,447 @@ func (p *Pipeline) Lower(context *Context) ([]interface{}, error) {
 	// a string containing literally "wait".
 	bkSteps := make([]interface{}, 0, 20)
 
+	// Each service's steps only depend on its own earlier steps, so with
+	// depends_on the services proceed independently, while with waits
+	// they run one after another.
+	serviceStages, err := p.lowerServiceStages(context)
+	if err != nil {
+		return nil, err
+	}
+	for _, stages := range serviceStages {
+		scopeStepKeys(stages)
+		if p.GroupSteps {
+			stages = groupStages(stages)
+		}
+		if p.UseDependsOn {
+			bkSteps = append(bkSteps, dependsOnSteps(stages)...)
+			continue
+		}
+		for _, stage := range stages {
+			if !stage.withPrevious {
+				bkSteps = append(bkSteps, bkWait)
+			}
+			for _, group := range stage.groups {
+				bkSteps = append(bkSteps, group.steps...)
+			}
+		}
+	}
+	return bkSteps, nil
+}
+
+// loweredStage is a set of lowered steps that run concurrently, once all
+// of the steps in the stages before it have finished.
+type loweredStage struct {
+	groups []*loweredGroup
+
+	// withPrevious is true for a stage that runs alongside the stage
+	// before it, rather than waiting for it.
+	withPrevious bool
+
+	// perEnvironment is true for the stages of the per-environment
+	// phases, with level the index of the level of the environment graph
+	// that they deploy to.
+	perEnvironment bool
+	level          int
+}
+
+// loweredGroup is the lowered steps of one phase, in one environment for
+// the per-environment phases. The steps that jobsworth adds itself are in
+// groups whose phase is named for what they do, like "record_deploy".
+type loweredGroup struct {
+	service     string
+	phase       string
+	emoji       string
+	environment string
+	steps       []interface{}
+
+	// after is the environments that the group's environment is deployed
+	// to after.
+	after []string
+}
+
+// lowerStages lowers the pipeline into the stages of steps that run for
+// the build described by the context.
+func (p *Pipeline) lowerStages(context *Context) ([]*loweredStage, error) {
+	var stages []*loweredStage
+
+	globalPhases, envPhases, err := p.orderedPhases()
+	if err != nil {
+		return nil, err
+	}
+
+	rule, err := p.selectRule(context)
+	if err != nil {
+		return nil, err
+	}
+	if rule == nil {
+		// No rule matches this branch, so there is nothing to do.
+		return stages, nil
+	}
+
 	if context.ArtifactsFromBuildNumber == "" {
-		if len(p.SmokeTest) > 0 {
+		for _, phase := range globalPhases {
+			if !phase.runs(rule, context) {
+				continue
+			}
 			stepContext := &StepContext{
 				EnvironmentName: context.BuildEnvironment,
-				QueueName:       "smoke_test",
-				EmojiName:       "interrobang",
+				QueueName:       phase.Queue,
+				EmojiName:       phase.Emoji,
+				Defaults:        phase.defaults,
 			}
 			loweredSteps, err := lowerSteps(
-				p.SmokeTest, context, stepContext,
+				phase.Steps, context, stepContext,
 			)
 			if err != nil {
-				return nil, err
+				return nil, fmt.Errorf("phase %s: %s", phase.name, err)
 			}
-			bkSteps = append(bkSteps, bkWait)
-			bkSteps = append(bkSteps, loweredSteps...)
+			stages = append(stages, &loweredStage{
+				groups: []*loweredGroup{{
+					phase: phase.name,
+					emoji: phase.Emoji,
+					steps: loweredSteps,
+				}},
+			})
 		}
 	}
 
-	if context.BranchName == "master" {
+	runsDeploy, deployQueue := deployPhase(envPhases, rule, context)
 
-		if context.ArtifactsFromBuildNumber == "" {
-			if len(p.Build) > 0 {
-				stepContext := &StepContext{
-					EnvironmentName: context.BuildEnvironment,
-					QueueName:       "build",
-					EmojiName:       "package",
-				}
-				loweredSteps, err := lowerSteps(
-					p.Build, context, stepContext,
-				)
-				if err != nil {
-					return nil, err
+	if runsDeploy {
+		envs, envNames, err := p.deployEnvironments(context, rule)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(context.SkipDeployEnvironments) > 0 {
+			annotationStep, err := skippedDeploysAnnotationStep(context)
+			if err != nil {
+				return nil, err
+			}
+			stages = append(stages, &loweredStage{
+				groups: []*loweredGroup{{
+					phase: "skipped_deploys",
+					emoji: "fast_forward",
+					steps: []interface{}{annotationStep},
+				}},
+				withPrevious: true,
+			})
+
+			keepNames := make([]string, 0, len(envNames))
+			for _, envName := range envNames {
+				if _, skip := context.SkipDeployEnvironments[envName]; !skip {
+					keepNames = append(keepNames, envName)
 				}
-				bkSteps = append(bkSteps, bkWait)
-				bkSteps = append(bkSteps, loweredSteps...)
+			}
+			envs, envNames, err = restrictEnvironments(envs, envNames, keepNames)
+			if err != nil {
+				return nil, err
 			}
 		}
 
-		if len(p.Deploy) > 0 {
+		// Frozen environments are either left out, like skipped ones, or
+		// have their steps replaced by a block step explaining why.
+		blockFrozen := map[string]*FreezeWindow{}
+		if len(context.FrozenEnvironments) > 0 {
+			keepNames := make([]string, 0, len(envNames))
+			for _, envName := range envNames {
+				window := context.FrozenEnvironments[envName]
+				if window != nil && window.Action == "omit" {
+					continue
+				}
+				if window != nil {
+					blockFrozen[envName] = window
+				}
+				keepNames = append(keepNames, envName)
+			}
+			envs, envNames, err = restrictEnvironments(envs, envNames, keepNames)
+			if err != nil {
+				return nil, err
+			}
+		}
 
-			trivialEnvs := p.TrivialDeployEnvs
-			cautiousEnvs := p.CautiousDeployEnvs
+		levels, err := environmentLevels(envs, envNames)
+		if err != nil {
+			return nil, err
+		}
 
-			if context.OverrideDeployEnvironmentName != "" {
-				trivialEnvs = []string{}
-				cautiousEnvs = []string{context.OverrideDeployEnvironmentName}
+		// Each level of the environment graph runs through all of the
+		// per-environment phases before we move on to the next, while
+		// the environments within a level are handled concurrently.
+		for levelIndex, level := range levels {
+			// Deploys that need approval wait for it before any of the
+			// environment's phases start.
+			approvalStage := &loweredStage{perEnvironment: true, level: levelIndex}
+			var deployLevel []string
+			for _, envName := range level {
+				env := envs[envName]
+				if window := blockFrozen[envName]; window != nil {
+					stepContext := &StepContext{
+						EnvironmentName: envName,
+						EmojiName:       "snowflake",
+						Environment:     env,
+					}
+					freezeStep, err := lowerStep(freezeStep(envName, window), context, stepContext)
+					if err != nil {
+						return nil, fmt.Errorf("freeze: %s", err)
+					}
+					approvalStage.groups = append(approvalStage.groups, &loweredGroup{
+						phase:       "freeze",
+						emoji:       "snowflake",
+						environment: envName,
+						steps:       []interface{}{freezeStep},
+						after:       env.After,
+					})
+					continue
+				}
+				deployLevel = append(deployLevel, envName)
+				if !p.requiresApproval(env) {
+					continue
+				}
+				stepContext := &StepContext{
+					EnvironmentName: envName,
+					EmojiName:       "raised_hand",
+					Cautious:        env.Cautious,
+					Environment:     env,
+				}
+				approvalStep, err := lowerStep(p.Approval.step(envName), context, stepContext)
+				if err != nil {
+					return nil, fmt.Errorf("approval: %s", err)
+				}
+				approvalStage.groups = append(approvalStage.groups, &loweredGroup{
+					phase:       "approval",
+					emoji:       "raised_hand",
+					environment: envName,
+					steps:       []interface{}{approvalStep},
+					after:       env.After,
+				})
+			}
+			if len(approvalStage.groups) > 0 {
+				stages = append(stages, approvalStage)
 			}
 
-			if len(trivialEnvs) > 0 {
-				bkSteps = append(bkSteps, bkWait)
-
-				// Trivial deploys to different environments can run
-				// concurrently
-				for _, envName := range trivialEnvs {
+			for _, phase := range envPhases {
+				if !phase.runs(rule, context) {
+					continue
+				}
+				if len(deployLevel) == 0 {
+					break
+				}
+				stage := &loweredStage{perEnvironment: true, level: levelIndex}
+				for _, envName := range deployLevel {
+					env := envs[envName]
 					stepContext := &StepContext{
 						EnvironmentName:    envName,
-						QueueName:          "deploy",
-						EmojiName:          "truck",
+						QueueName:          phase.Queue,
+						EmojiName:          phase.Emoji,
+						Cautious:           env.Cautious && phase.builtin == "deploy",
 						PreventConcurrency: true,
+						Environment:        env,
+						Defaults:           phase.defaults,
+					}
+					if p.requiresApproval(env) {
+						stepContext.ApprovalFields = p.Approval.fieldEnv(envName)
 					}
 					loweredSteps, err := lowerSteps(
-						p.Deploy, context, stepContext,
+						phase.Steps, context, stepContext,
 					)
 					if err != nil {
-						return nil, err
+						return nil, fmt.Errorf("phase %s: %s", phase.name, err)
 					}
-					bkSteps = append(bkSteps, loweredSteps...)
+					stage.groups = append(stage.groups, &loweredGroup{
+						phase:       phase.name,
+						emoji:       phase.Emoji,
+						environment: envName,
+						steps:       loweredSteps,
+						after:       env.After,
+					})
 				}
+				stages = append(stages, stage)
+			}
 
-				if len(p.ValidationTest) > 0 {
-					bkSteps = append(bkSteps, bkWait)
-					for _, envName := range trivialEnvs {
-						stepContext := &StepContext{
-							EnvironmentName:    envName,
-							QueueName:          "validation_test",
-							EmojiName:          "curly_loop",
-							PreventConcurrency: true,
-						}
-						loweredSteps, err := lowerSteps(
-							p.ValidationTest, context, stepContext,
-						)
-						if err != nil {
-							return nil, err
-						}
-						bkSteps = append(bkSteps, loweredSteps...)
+			if p.RecordDeployHistory && len(deployLevel) > 0 {
+				// Once an environment has been validated we record
+				// what is now running there.
+				stage := &loweredStage{perEnvironment: true, level: levelIndex}
+				for _, envName := range deployLevel {
+					recordStep, err := deployRecordStep(context, envName)
+					if err != nil {
+						return nil, err
 					}
+					stepContext := &StepContext{
+						EnvironmentName: envName,
+						QueueName:       deployQueue,
+						EmojiName:       "memo",
+						Environment:     envs[envName],
+					}
+					loweredStep, err := lowerStep(recordStep, context, stepContext)
+					if err != nil {
+						return nil, err
+					}
+					stage.groups = append(stage.groups, &loweredGroup{
+						phase:       "record_deploy",
+						emoji:       "memo",
+						environment: envName,
+						steps:       []interface{}{loweredStep},
+						after:       envs[envName].After,
+					})
 				}
+				stages = append(stages, stage)
 			}
+		}
+	}
 
-			for _, envName := range cautiousEnvs {
-				deployContext := &StepContext{
-					EnvironmentName:    envName,
-					QueueName:          "deploy",
-					EmojiName:          "truck",
-					Cautious:           true,
-					PreventConcurrency: true,
-				}
-				validateContext := &StepContext{
-					EnvironmentName:    envName,
-					QueueName:          "validation_test",
-					EmojiName:          "curly_loop",
-					PreventConcurrency: true,
-				}
+	return stages, nil
+}
 
-				// Manual deploys run sequentially, so that they can
-				// potentially add blocking steps.
-				bkSteps = append(bkSteps, bkWait)
+// groupStages wraps the steps of each phase that runs once per build in a
+// Buildkite group step, so that the Buildkite UI can collapse them. The
+// steps of all of the per-environment phases for an environment are
+// wrapped in a single group for each level of the environment graph, with
+// waits inside the group between the phases.
+//
+// The steps within a group keep their concurrency groups, so deploys to an
+// environment are still serialized across builds.
+func groupStages(stages []*loweredStage) []*loweredStage {
+	var grouped []*loweredStage
+	var levelStage *loweredStage
+	var envGroups map[string]*loweredGroup
+
+	for _, stage := range stages {
+		if stage.withPrevious {
+			// Steps that run alongside others are left as they are.
+			grouped = append(grouped, stage)
+			continue
+		}
+		if !stage.perEnvironment {
+			levelStage = nil
+			groupedStage := &loweredStage{}
+			for _, group := range stage.groups {
+				groupedStage.groups = append(groupedStage.groups, &loweredGroup{
+					service: group.service,
+					phase:   group.phase,
+					emoji:   group.emoji,
+					steps:   group.steps,
+				})
+			}
+			grouped = append(grouped, groupedStage)
+			continue
+		}
 
-				loweredSteps, err := lowerSteps(
-					p.Deploy, context, deployContext,
-				)
-				if err != nil {
-					return nil, err
+		if levelStage == nil || levelStage.level != stage.level {
+			levelStage = &loweredStage{perEnvironment: true, level: stage.level}
+			envGroups = map[string]*loweredGroup{}
+			grouped = append(grouped, levelStage)
+		}
+		for _, group := range stage.groups {
+			envGroup := envGroups[group.environment]
+			if envGroup == nil {
+				envGroup = &loweredGroup{
+					service:     group.service,
+					phase:       group.phase,
+					emoji:       group.emoji,
+					environment: group.environment,
+					after:       group.after,
 				}
-				bkSteps = append(bkSteps, loweredSteps...)
+				envGroups[group.environment] = envGroup
+				levelStage.groups = append(levelStage.groups, envGroup)
+			} else {
+				envGroup.steps = append(envGroup.steps, bkWait)
+			}
+			envGroup.steps = append(envGroup.steps, group.steps...)
+		}
+	}
 
-				if len(p.ValidationTest) > 0 {
-					loweredSteps, err := lowerSteps(
-						p.ValidationTest, context, validateContext,
-					)
-					if err != nil {
-						return nil, err
-					}
-					bkSteps = append(bkSteps, bkWait)
-					bkSteps = append(bkSteps, loweredSteps...)
+	for _, stage := range grouped {
+		if stage.withPrevious {
+			continue
+		}
+		for _, group := range stage.groups {
+			label := group.phase
+			if group.environment != "" {
+				label = group.environment
+			}
+			if group.service != "" {
+				label = group.service + " " + label
+			}
+			group.steps = []interface{}{Step{
+				"group": fmt.Sprintf(":%s: %s", group.emoji, label),
+				"steps": group.steps,
+			}}
+		}
+	}
+	return grouped
+}
+
+// deployPhase returns whether the deploy phase runs under the given rule,
+// and the queue that it runs on.
+func deployPhase(envPhases []*Phase, rule *BranchRule, context *Context) (bool, string) {
+	for _, phase := range envPhases {
+		if phase.name == "deploy" {
+			return phase.runs(rule, context), phase.Queue
+		}
+	}
+	return false, ""
+}
+
+// DeployEnvironmentNames returns the names of the environments that the
+// build described by the context will deploy to.
+func (p *Pipeline) DeployEnvironmentNames(context *Context) ([]string, error) {
+	if len(p.Services) > 0 {
+		// Services can share environments, which are only listed once.
+		var envNames []string
+		seen := map[string]bool{}
+		for _, name := range p.serviceNames() {
+			service := p.Services[name]
+			if !context.changedPathsMatch(service.Paths) {
+				continue
+			}
+			serviceEnvNames, err := service.Pipeline.DeployEnvironmentNames(service.context(context))
+			if err != nil {
+				return nil, fmt.Errorf("service %s: %s", name, err)
+			}
+			for _, envName := range serviceEnvNames {
+				if !seen[envName] {
+					seen[envName] = true
+					envNames = append(envNames, envName)
 				}
 			}
 		}
+		return envNames, nil
 	}
 
-	return bkSteps, nil
+	_, envPhases, err := p.orderedPhases()
+	if err != nil {
+		return nil, err
+	}
+	rule, err := p.selectRule(context)
+	if err != nil || rule == nil {
+		return nil, err
+	}
+	if runsDeploy, _ := deployPhase(envPhases, rule, context); !runsDeploy {
+		return nil, nil
+	}
+	_, envNames, err := p.deployEnvironments(context, rule)
+	return envNames, err
 }
 
 func lowerStep(step Step, context *Context, stepContext *StepContext) (Step, error) {
 	step = deepCopyStep(step)
+	if isCommandStep(step) {
+		defaults := stepContext.Defaults
+		if envConfig := stepContext.Environment; envConfig != nil && len(defaults) > 0 {
+			// The environment's own variables take precedence over
+			// the defaults, which otherwise count as part of the step.
+			defaults = deepCopyStep(defaults)
+			if defaultEnv, ok := defaults["env"].(map[interface{}]interface{}); ok {
+				for k := range envConfig.Env {
+					delete(defaultEnv, k)
+				}
+			}
+		}
+		step = applyStepDefaults(defaults, step)
+	}
 
 	err := interpolateStep(step, context, stepContext)
 	if err != nil {
@@ -203,10 +603,11 @@ func lowerStep(step Step, context *Context, stepContext *StepContext) (Step, err
 	}
 	step["name"] = strings.TrimSpace(fmt.Sprintf(":%s: %s", stepContext.EmojiName, name))
 
-	// Block and wait steps must not contains agents or env, so we return early here
+	// Block, input and wait steps must not contains agents or env, so we return early here
 	_, isBlockStep := step["block"]
+	_, isInputStep := step["input"]
 	_, isWaitStep := step["wait"]
-	if isBlockStep || isWaitStep {
+	if isBlockStep || isInputStep || isWaitStep {
 		return step, nil
 	}
 
@@ -224,15 +625,45 @@ func lowerStep(step Step, context *Context, stepContext *StepContext) (Step, err
 		step["env"] = env
 	}
 
+	if envConfig := stepContext.Environment; envConfig != nil {
+		for k, v := range envConfig.Agents {
+			agents[k] = v
+		}
+		if envConfig.Queue != "" {
+			agents["queue"] = envConfig.Queue
+		}
+		for k, v := range envConfig.Env {
+			if _, exists := env[k]; !exists {
+				env[k] = v
+			}
+		}
+	}
+	for k, v := range stepContext.ApprovalFields {
+		env[k] = v
+	}
+
 	env["JOBSWORTH_CAUTIOUS"] = stepContext.CautiousStr()
 	env["JOBSWORTH_CODEBASE"] = context.CodebaseName()
 	env["JOBSWORTH_CODE_VERSION"] = context.CodeVersion
 	env["JOBSWORTH_SOURCE_GIT_COMMIT_ID"] = context.SourceGitCommitId
 	env["JOBSWORTH_ENVIRONMENT"] = stepContext.EnvironmentName
+	if context.ServiceName != "" {
+		env["JOBSWORTH_SERVICE"] = context.ServiceName
+		env["JOBSWORTH_SERVICE_PATH"] = context.ServicePath
+	}
+	if context.InPullRequest {
+		env["JOBSWORTH_PULL_REQUEST"] = context.PullRequestStr()
+		env["JOBSWORTH_PULL_REQUEST_NUMBER"] = context.PullRequestNumber
+		env["JOBSWORTH_PULL_REQUEST_BASE_BRANCH"] = context.PullRequestBaseBranch
+	}
 
 	if step["command"] != nil && stepContext.PreventConcurrency &&
 		step["concurrency"] == nil && step["concurrency_group"] == nil {
 		step["concurrency_group"] = fmt.Sprintf("%s/%s", stepContext.EnvironmentName, context.BuildkitePipelineSlug)
+		if context.ServiceName != "" {
+			// Services deploy independently of one another.
+			step["concurrency_group"] = fmt.Sprintf("%s/%s", step["concurrency_group"], context.ServiceName)
+		}
 		step["concurrency"] = 1
 		if step["concurrency_method"] == nil {
 			step["concurrency_method"] = "eager"
@@ -242,6 +673,32 @@ func lowerStep(step Step, context *Context, stepContext *StepContext) (Step, err
 	return step, nil
 }
 
+// isCommandStep returns true if the step isn't one of Buildkite's other
+// types of step, which don't accept the keys that command steps do.
+func isCommandStep(step Step) bool {
+	for _, stepType := range []string{"wait", "block", "input", "trigger", "group"} {
+		if _, ok := step[stepType]; ok {
+			return false
+		}
+	}
+	return true
+}
+
+// applyStepDefaults returns a copy of the defaults with the step merged
+// into it. Mappings like env and agents are merged key by key, while any
+// other value the step sets, including lists like plugins, replaces the
+// default entirely.
+func applyStepDefaults(defaults Step, step Step) Step {
+	if len(defaults) == 0 {
+		return step
+	}
+	merged := deepCopyStep(defaults)
+	for k, v := range step {
+		merged[k] = mergeYAML(merged[k], v)
+	}
+	return merged
+}
+
 func lowerSteps(steps []Step, context *Context, stepContext *StepContext) ([]interface{}, error) {
 	ret := make([]interface{}, len(steps))
 	for i, step := range steps {
@@ -256,6 +713,39 @@ func lowerSteps(steps []Step, context *Context, stepContext *StepContext) ([]int
 
 // Modifies a step in-place to expand all of the interpolation expressions
 func interpolateStep(step Step, context *Context, stepContext *StepContext) error {
+	evalConfig := &hil.EvalConfig{
+		GlobalScope: interpolationScope(context, stepContext),
+	}
+	return hil.Walk(step, func(d *hil.WalkData) error {
+		result, _, err := hil.Eval(d.Root, evalConfig)
+		if err != nil {
+			// Unfortunately, there is no way to know which field gave an error
+			return fmt.Errorf("%s %s", d.Location, err)
+		}
+		d.Replace = true
+		d.ReplaceValue = result.(string)
+		return nil
+	})
+}
+
+// interpolateString expands the interpolation expressions in a single
+// string, with the same variables that are available to steps.
+func interpolateString(s string, context *Context, stepContext *StepContext) (string, error) {
+	tree, err := hil.Parse(s)
+	if err != nil {
+		return "", err
+	}
+	evalConfig := &hil.EvalConfig{
+		GlobalScope: interpolationScope(context, stepContext),
+	}
+	result, _, err := hil.Eval(tree, evalConfig)
+	if err != nil {
+		return "", err
+	}
+	return result.(string), nil
+}
+
+func interpolationScope(context *Context, stepContext *StepContext) *hilAST.BasicScope {
 	scope := &hilAST.BasicScope{
 		VarMap: map[string]hilAST.Variable{
 			"environment": {
@@ -282,21 +772,33 @@ func interpolateStep(step Step, context *Context, stepContext *StepContext) erro
 				Value: stepContext.CautiousStr(),
 				Type:  hilAST.TypeString,
 			},
+			"tag": {
+				Value: context.TagName,
+				Type:  hilAST.TypeString,
+			},
+			"pull_request": {
+				Value: context.PullRequestStr(),
+				Type:  hilAST.TypeString,
+			},
+			"pull_request_number": {
+				Value: context.PullRequestNumber,
+				Type:  hilAST.TypeString,
+			},
+			"pull_request_base_branch": {
+				Value: context.PullRequestBaseBranch,
+				Type:  hilAST.TypeString,
+			},
 		},
 	}
-	evalConfig := &hil.EvalConfig{
-		GlobalScope: scope,
-	}
-	return hil.Walk(step, func(d *hil.WalkData) error {
-		result, _, err := hil.Eval(d.Root, evalConfig)
-		if err != nil {
-			// Unfortunately, there is no way to know which field gave an error
-			return fmt.Errorf("%s %s", d.Location, err)
+	if envConfig := stepContext.Environment; envConfig != nil {
+		for k, v := range envConfig.Variables {
+			scope.VarMap["env."+k] = hilAST.Variable{
+				Value: v,
+				Type:  hilAST.TypeString,
+			}
 		}
-		d.Replace = true
-		d.ReplaceValue = result.(string)
-		return nil
-	})
+	}
+	return scope
 }
 
 func deepCopyStep(in Step) Step {
@@ -3,6 +3,7 @@ package main
 import (
 	"github.com/go-test/deep"
 	"gopkg.in/yaml.v2"
+	"io"
 	"io/ioutil"
 	"reflect"
 	"strings"
@@ -130,15 +131,21 @@ func TestInterpolateUnknownVariable(t *testing.T) {
 }
 
 func testGenerateSteps(t *testing.T, isMaster bool, sourcePath, expectedPath string) {
+	branchName := ""
+	if isMaster {
+		branchName = "master"
+	}
+	testGenerateStepsForBranch(t, branchName, sourcePath, expectedPath)
+}
+
+func testGenerateStepsForBranch(t *testing.T, branchName, sourcePath, expectedPath string) {
 	context := Context{
 		ConfigFilename:        sourcePath,
 		BuildkitePipelineSlug: "myrepo",
-	}
-	if isMaster {
-		context.BranchName = "master"
+		BranchName:            branchName,
 	}
 	buildkite := DryRunBuildMetadataClient{}
-	bkSteps, _, err := generateSteps(&context, &buildkite)
+	bkSteps, _, err := generateSteps(&context, &buildkite, io.Discard)
 	if err != nil {
 		t.Error("generateSteps returned err:", err)
 	}
@@ -167,4 +174,566 @@ func testGenerateSteps(t *testing.T, isMaster bool, sourcePath, expectedPath str
 func TestGenerateSnapshots(t *testing.T) {
 	testGenerateSteps(t, false, "testdata/basic.in.yaml", "testdata/basic_non_master.out.yaml")
 	testGenerateSteps(t, true, "testdata/basic.in.yaml", "testdata/basic_master.out.yaml")
+	testGenerateSteps(t, true, "testdata/environments.in.yaml", "testdata/environments.out.yaml")
+	testGenerateSteps(t, true, "testdata/phases.in.yaml", "testdata/phases.out.yaml")
+	testGenerateStepsForBranch(t, "release/1.2", "testdata/branches.in.yaml", "testdata/branches_release.out.yaml")
+	testGenerateSteps(t, true, "testdata/history.in.yaml", "testdata/history.out.yaml")
+	testGenerateSteps(t, true, "testdata/groups.in.yaml", "testdata/groups.out.yaml")
+	testGenerateSteps(t, true, "testdata/depends_on.in.yaml", "testdata/depends_on.out.yaml")
+	testGenerateSteps(t, true, "testdata/keys.in.yaml", "testdata/keys.out.yaml")
+	testGenerateSteps(t, true, "testdata/approval.in.yaml", "testdata/approval.out.yaml")
+	testGenerateSteps(t, true, "testdata/include.in.yaml", "testdata/include.out.yaml")
+	testGenerateSteps(t, true, "testdata/defaults.in.yaml", "testdata/defaults.out.yaml")
+	testGenerateSteps(t, true, "testdata/services.in.yaml", "testdata/services.out.yaml")
+}
+
+func TestEnvironmentLevels(t *testing.T) {
+	envs := map[string]*Environment{
+		"dev":     {},
+		"qa":      {After: []string{"dev"}},
+		"staging": {After: []string{"qa"}},
+		"prod-us": {After: []string{"staging"}},
+		"prod-eu": {After: []string{"staging", "dev"}},
+	}
+	names := []string{"prod-us", "prod-eu", "staging", "qa", "dev"}
+	levels, err := environmentLevels(envs, names)
+	if err != nil {
+		t.Fatal("environmentLevels returned err:", err)
+	}
+	expected := [][]string{
+		{"dev"},
+		{"qa"},
+		{"staging"},
+		{"prod-us", "prod-eu"},
+	}
+	if diff := deep.Equal(expected, levels); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestEnvironmentLevelsCycle(t *testing.T) {
+	envs := map[string]*Environment{
+		"a": {After: []string{"c"}},
+		"b": {After: []string{"a"}},
+		"c": {After: []string{"b"}},
+	}
+	_, err := environmentLevels(envs, []string{"a", "b", "c"})
+	if err == nil {
+		t.Fatal("environmentLevels should error on a cycle")
+	}
+	if !strings.Contains(err.Error(), "a -> c -> b -> a") {
+		t.Error("message should describe the cycle", err.Error())
+	}
+}
+
+func TestEnvironmentLevelsUnknown(t *testing.T) {
+	envs := map[string]*Environment{
+		"a": {After: []string{"nope"}},
+	}
+	_, err := environmentLevels(envs, []string{"a"})
+	if err == nil {
+		t.Fatal("environmentLevels should error on an unknown environment")
+	}
+}
+
+func TestEnvironmentConfig(t *testing.T) {
+	context := &Context{}
+	stepContext := &StepContext{
+		EnvironmentName: "prod-eu",
+		QueueName:       "deploy",
+		Environment: &Environment{
+			Variables: map[string]string{"region": "eu-west-1"},
+			Env: map[string]string{
+				"REGION":   "eu-west-1",
+				"OVERRIDE": "from environment",
+			},
+			Agents: map[string]string{"environment": "prod"},
+			Queue:  "deploy-eu",
+		},
+	}
+
+	step := Step{}
+	stepBytes := []byte(`
+command: deploy --region=${env.region}
+env:
+  OVERRIDE: from step
+agents:
+  size: large
+`)
+	if err := yaml.Unmarshal(stepBytes, &step); err != nil {
+		t.Error("unmarshal error", err)
+	}
+	step, err := lowerStep(step, context, stepContext)
+	if err != nil {
+		t.Fatal("lowerStep returned err:", err)
+	}
+	if actual := step["command"]; actual != "deploy --region=eu-west-1" {
+		t.Error("environment variable was not interpolated", actual)
+	}
+	expectedAgents := map[interface{}]interface{}{
+		"environment": "prod",
+		"queue":       "deploy-eu",
+		"size":        "large",
+	}
+	if diff := deep.Equal(expectedAgents, step["agents"]); diff != nil {
+		t.Error(diff)
+	}
+	env := step["env"].(map[interface{}]interface{})
+	if env["REGION"] != "eu-west-1" {
+		t.Error("environment env should be merged", env["REGION"])
+	}
+	if env["OVERRIDE"] != "from step" {
+		t.Error("step env should take priority", env["OVERRIDE"])
+	}
+	if env["JOBSWORTH_ENVIRONMENT"] != "prod-eu" {
+		t.Error("JOBSWORTH_ENVIRONMENT should be the environment name", env["JOBSWORTH_ENVIRONMENT"])
+	}
+}
+
+func TestOrderedPhases(t *testing.T) {
+	pipeline := &Pipeline{
+		Phases: map[string]*Phase{
+			"lint":   {Before: "smoke_test"},
+			"scan":   {After: "smoke_test"},
+			"sign":   {After: "scan"},
+			"notify": {After: "validation_test"},
+			"audit":  {After: "validation_test"},
+		},
+	}
+	global, perEnv, err := pipeline.orderedPhases()
+	if err != nil {
+		t.Fatal("orderedPhases returned err:", err)
+	}
+	phaseNames := func(phases []*Phase) []string {
+		names := make([]string, len(phases))
+		for i, phase := range phases {
+			names[i] = phase.name
+		}
+		return names
+	}
+	if diff := deep.Equal(
+		[]string{"lint", "smoke_test", "scan", "sign", "build"},
+		phaseNames(global),
+	); diff != nil {
+		t.Error("global phases", diff)
+	}
+	if diff := deep.Equal(
+		[]string{"deploy", "validation_test", "audit", "notify"},
+		phaseNames(perEnv),
+	); diff != nil {
+		t.Error("per-environment phases", diff)
+	}
+	if perEnv[3].builtin != "validation_test" || perEnv[3].Queue != "notify" {
+		t.Error("custom phase should default its queue and inherit its anchor", perEnv[3])
+	}
+}
+
+func TestOrderedPhasesErrors(t *testing.T) {
+	tests := map[string]map[string]*Phase{
+		"cycle": {
+			"a": {After: "b"},
+			"b": {After: "a"},
+		},
+		"unknown phase foo": {
+			"a": {After: "foo"},
+		},
+		"must have either before or after": {
+			"a": {},
+		},
+		"cannot be repositioned": {
+			"build": {After: "deploy"},
+		},
+	}
+	for expected, phases := range tests {
+		pipeline := &Pipeline{Phases: phases}
+		_, _, err := pipeline.orderedPhases()
+		if err == nil {
+			t.Errorf("orderedPhases should fail with %q", expected)
+			continue
+		}
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("error %q should contain %q", err, expected)
+		}
+	}
+}
+
+func TestBranchRule(t *testing.T) {
+	pipeline := &Pipeline{
+		Branches: []*BranchRule{
+			{Pattern: "main"},
+			{Pattern: "release/*", Environments: []string{"staging"}},
+			{Pattern: "/^hotfix-[0-9]+$/", Phases: []string{"build"}},
+			{Pattern: "feature/*", Phases: []string{"smoke_test"}},
+		},
+	}
+	tests := map[string]string{
+		"main":              "main",
+		"maintenance":       "",
+		"release/1.2":       "release/*",
+		"release/1.2/rc1":   "release/*",
+		"hotfix-12":         "/^hotfix-[0-9]+$/",
+		"hotfix-twelve":     "",
+		"feature/new-thing": "feature/*",
+	}
+	for branchName, expected := range tests {
+		rule, err := pipeline.branchRule(branchName)
+		if err != nil {
+			t.Fatal("branchRule returned err:", err)
+		}
+		actual := ""
+		if rule != nil {
+			actual = rule.Pattern
+		}
+		if actual != expected {
+			t.Errorf("branch %s matched %q, not %q", branchName, actual, expected)
+		}
+	}
+
+	pipeline.Branches = []*BranchRule{{Pattern: "/[/"}}
+	if _, err := pipeline.branchRule("main"); err == nil {
+		t.Error("branchRule should fail for an invalid regular expression")
+	}
+}
+
+func TestRestrictEnvironments(t *testing.T) {
+	envs := map[string]*Environment{
+		"dev":     {},
+		"qa":      {After: []string{"dev"}},
+		"staging": {After: []string{"qa"}},
+		"prod":    {After: []string{"staging"}},
+	}
+	names := []string{"dev", "qa", "staging", "prod"}
+	restricted, restrictedNames, err := restrictEnvironments(envs, names, []string{"prod", "dev"})
+	if err != nil {
+		t.Fatal("restrictEnvironments returned err:", err)
+	}
+	if diff := deep.Equal([]string{"dev", "prod"}, restrictedNames); diff != nil {
+		t.Error(diff)
+	}
+	if diff := deep.Equal([]string{"dev"}, restricted["prod"].After); diff != nil {
+		t.Error("prod should still be after dev", diff)
+	}
+	if len(envs["prod"].After) != 1 || envs["prod"].After[0] != "staging" {
+		t.Error("the original graph should not be modified")
+	}
+
+	if _, _, err := restrictEnvironments(envs, names, []string{"nope"}); err == nil {
+		t.Error("restrictEnvironments should fail for an unknown environment")
+	}
+}
+
+func TestPullRequest(t *testing.T) {
+	pipeline := &Pipeline{}
+	pipelineBytes := []byte(`
+smoke_test:
+- command: make test
+build:
+- command: make build
+deploy:
+- command: make deploy
+environments:
+  qa:
+  prod:
+    after: [qa]
+pull_request:
+  phases: [smoke_test, deploy]
+  preview_environment:
+    name: pr-${pull_request_number}
+    agents:
+      environment: preview
+`)
+	if err := yaml.Unmarshal(pipelineBytes, pipeline); err != nil {
+		t.Fatal("unmarshal error", err)
+	}
+	context := &Context{
+		BranchName:            "feature/thing",
+		InPullRequest:         true,
+		PullRequestNumber:     "42",
+		PullRequestBaseBranch: "master",
+	}
+	bkSteps, err := pipeline.Lower(context)
+	if err != nil {
+		t.Fatal("Lower returned err:", err)
+	}
+	if len(bkSteps) != 4 {
+		t.Fatal("expected smoke test and preview deploy steps", bkSteps)
+	}
+	deployStep := bkSteps[3].(Step)
+	env := deployStep["env"].(map[interface{}]interface{})
+	if env["JOBSWORTH_ENVIRONMENT"] != "pr-42" {
+		t.Error("preview environment name should be interpolated", env["JOBSWORTH_ENVIRONMENT"])
+	}
+	if env["JOBSWORTH_PULL_REQUEST_NUMBER"] != "42" || env["JOBSWORTH_PULL_REQUEST_BASE_BRANCH"] != "master" {
+		t.Error("pull request env should be set", env)
+	}
+	agents := deployStep["agents"].(map[interface{}]interface{})
+	if agents["environment"] != "preview" {
+		t.Error("preview environment agents should be applied", agents)
+	}
+
+	// Without a pull request the branch rules apply as usual.
+	context.InPullRequest = false
+	bkSteps, err = pipeline.Lower(context)
+	if err != nil {
+		t.Fatal("Lower returned err:", err)
+	}
+	if len(bkSteps) != 2 {
+		t.Error("expected only smoke test steps", bkSteps)
+	}
+}
+
+func TestTagBuild(t *testing.T) {
+	tests := []struct {
+		tagName             string
+		expectedCodeVersion string
+		expectedEnvs        []string
+	}{
+		{"v1.2.3", "v1.2.3", []string{"staging", "prod"}},
+		{"v1.3.0-rc1", "original", []string{"staging"}},
+		{"experiment", "original", nil},
+	}
+	for _, test := range tests {
+		context := &Context{
+			ConfigFilename: "testdata/tags.in.yaml",
+			BranchName:     test.tagName,
+			TagName:        test.tagName,
+			CodeVersion:    "original",
+		}
+		buildkite := DryRunBuildMetadataClient{}
+		bkSteps, writeMetadata, err := generateSteps(context, &buildkite, io.Discard)
+		if err != nil {
+			t.Fatal("generateSteps returned err:", err)
+		}
+		if actual := writeMetadata["jobsworth:code_version"]; actual != test.expectedCodeVersion {
+			t.Errorf("tag %s: code version %q, not %q", test.tagName, actual, test.expectedCodeVersion)
+		}
+		var envs []string
+		for _, bkStep := range bkSteps {
+			step, ok := bkStep.(Step)
+			if !ok {
+				continue
+			}
+			if step["command"] == "make build VERSION="+test.tagName {
+				continue
+			}
+			envs = append(envs, step["agents"].(map[interface{}]interface{})["environment"].(string))
+		}
+		if diff := deep.Equal(test.expectedEnvs, envs); diff != nil {
+			t.Errorf("tag %s: %s", test.tagName, diff)
+		}
+	}
+}
+
+// testBuildMetadataClient is a dry-run client with a canned deploy history.
+type testBuildMetadataClient struct {
+	DryRunBuildMetadataClient
+	lastDeploys map[string]*DeployRecord
+}
+
+// ReadLastDeploy returns the canned record, keyed by its metadata key.
+func (c *testBuildMetadataClient) ReadLastDeploy(serviceName, environmentName string) (*DeployRecord, error) {
+	return c.lastDeploys[deployHistoryMetadataKey(serviceName, environmentName)], nil
+}
+
+func TestSkipIfAlreadyDeployed(t *testing.T) {
+	context := &Context{
+		ConfigFilename:    "testdata/skip_deployed.in.yaml",
+		BranchName:        "master",
+		SourceGitCommitId: "abc123",
+	}
+	buildkite := &testBuildMetadataClient{
+		lastDeploys: map[string]*DeployRecord{
+			"jobsworth:deployed:dev": {BuildNumber: 10, CodeVersion: "v10", SourceCommitId: "abc123"},
+			"jobsworth:deployed:qa":  {BuildNumber: 9, CodeVersion: "v9", SourceCommitId: "def456"},
+		},
+	}
+	bkSteps, _, err := generateSteps(context, buildkite, io.Discard)
+	if err != nil {
+		t.Fatal("generateSteps returned err:", err)
+	}
+
+	annotationStep := bkSteps[0].(Step)
+	annotation := annotationStep["env"].(map[interface{}]interface{})["JOBSWORTH_ANNOTATION"].(string)
+	if !strings.Contains(annotation, "dev is already running v10 (commit abc123) from build #10") {
+		t.Error("annotation should explain the skipped deploy", annotation)
+	}
+
+	var deployedEnvs []string
+	for _, bkStep := range bkSteps[1:] {
+		if step, ok := bkStep.(Step); ok && step["command"] == "make deploy" {
+			deployedEnvs = append(deployedEnvs, step["agents"].(map[interface{}]interface{})["environment"].(string))
+		}
+	}
+	if diff := deep.Equal([]string{"qa", "prod"}, deployedEnvs); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestOverrideEnvironments(t *testing.T) {
+	tests := []struct {
+		branch   string
+		message  string
+		commands []string
+		err      string
+	}{
+		{
+			"master",
+			"Deploy #12 to qa, staging and prod-us",
+			[]string{"deploy qa", "integrationtest", "deploy staging", "integrationtest", "deploy prod-us", "integrationtest"},
+			"",
+		},
+		{
+			"master",
+			"Deploy to typo-env and qa",
+			nil,
+			"build message names unknown environment typo-env (expected one of dev, prod-eu, prod-us, qa, staging)",
+		},
+		{
+			"master",
+			"Force deploy to qa and scratch",
+			[]string{"deploy qa", "integrationtest", "deploy scratch", "integrationtest"},
+			"",
+		},
+		{
+			"master",
+			"Deploy to qa and then run smoke tests",
+			[]string{"deploy qa", "integrationtest"},
+			"",
+		},
+		{
+			"master",
+			"Deploy tooling cleanup",
+			nil,
+			"build message names unknown environment tooling",
+		},
+		// Branches that don't deploy ignore the message.
+		{"feature/tooling", "Deploy tooling cleanup", nil, ""},
+		{"feature/tooling", "Deploy to qa and then run smoke tests", nil, ""},
+	}
+	for _, test := range tests {
+		context := &Context{
+			ConfigFilename: "testdata/environments.in.yaml",
+			BranchName:     test.branch,
+			BuildMessage:   test.message,
+		}
+		context.DoMessageMagic()
+		bkSteps, _, err := generateSteps(context, &DryRunBuildMetadataClient{}, io.Discard)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%q: expected error %q, got %v", test.message, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal("generateSteps returned err:", err)
+		}
+
+		var commands []string
+		for i, bkStep := range bkSteps {
+			step, ok := bkStep.(Step)
+			if !ok {
+				continue
+			}
+			commands = append(commands, step["command"].(string))
+			// Each environment waits for the one before it.
+			if i > 0 && bkSteps[i-1] != bkWait {
+				t.Errorf("%q: step %d should follow a wait", test.message, i)
+			}
+			env := step["env"].(map[interface{}]interface{})
+			if env["JOBSWORTH_CAUTIOUS"] != "1" && strings.HasPrefix(step["command"].(string), "deploy ") {
+				t.Errorf("%q: %s should be cautious", test.message, step["command"])
+			}
+		}
+		if diff := deep.Equal(test.commands, commands); diff != nil {
+			t.Errorf("%q: %s", test.message, diff)
+		}
+	}
+}
+
+// rollbackBuildMetadataClient records the environments it's asked to find
+// the previous deploy to.
+type rollbackBuildMetadataClient struct {
+	DryRunBuildMetadataClient
+	lookups []string
+}
+
+func (c *rollbackBuildMetadataClient) FindPreviousGoodDeploy(environmentName, agentEnvironment string, beforeNumber uint64) (string, error) {
+	c.lookups = append(c.lookups, environmentName)
+	return "7", nil
+}
+
+func TestRollbackEnvironment(t *testing.T) {
+	tests := []struct {
+		filename  string
+		branch    string
+		message   string
+		lookups   []string
+		artifacts string
+	}{
+		{"testdata/environments.in.yaml", "master", "Roll back qa", []string{"qa"}, "7"},
+		{"testdata/adhoc.in.yaml", "master", "Roll back to sandbox-12", []string{"sandbox-12"}, "7"},
+		// Messages that don't name an environment are ordinary messages.
+		{"testdata/environments.in.yaml", "master", "Rollback the logging change", nil, ""},
+		{"testdata/environments.in.yaml", "feature/x", "Rollback the logging change", nil, ""},
+		{"testdata/adhoc.in.yaml", "master", "Roll back sandbox-tmp", nil, ""},
+		// Branches that don't deploy don't look for the previous deploy.
+		{"testdata/environments.in.yaml", "feature/x", "Roll back qa", nil, ""},
+	}
+	for _, test := range tests {
+		context := &Context{
+			ConfigFilename: test.filename,
+			BranchName:     test.branch,
+			BuildMessage:   test.message,
+		}
+		context.DoMessageMagic()
+		buildkite := &rollbackBuildMetadataClient{}
+		if _, _, err := generateSteps(context, buildkite, io.Discard); err != nil {
+			t.Errorf("%q on %s: generateSteps returned err: %s", test.message, test.branch, err)
+			continue
+		}
+		if diff := deep.Equal(test.lookups, buildkite.lookups); diff != nil {
+			t.Errorf("%q on %s: lookups: %s", test.message, test.branch, diff)
+		}
+		if context.ArtifactsFromBuildNumber != test.artifacts {
+			t.Errorf(
+				"%q on %s: artifacts from build %q, not %q",
+				test.message, test.branch, context.ArtifactsFromBuildNumber, test.artifacts,
+			)
+		}
+	}
+}
+
+func TestAdhocEnvironments(t *testing.T) {
+	tests := []struct {
+		message string
+		err     string
+	}{
+		{"Deploy to qa and loadtest", ""},
+		{"Deploy to qa-payments, sandbox-12 and prod", ""},
+		{
+			"Deploy to typo-env",
+			"build message names unknown environment typo-env (expected one of prod, qa, " +
+				"or a name matching adhoc_environments loadtest, qa-*, /^sandbox-[0-9]+$/)",
+		},
+		{
+			"Force deploy to sandbox-tmp",
+			"build message names unknown environment sandbox-tmp",
+		},
+	}
+	for _, test := range tests {
+		context := &Context{
+			ConfigFilename: "testdata/adhoc.in.yaml",
+			BranchName:     "master",
+			BuildMessage:   test.message,
+		}
+		context.DoMessageMagic()
+		_, _, err := generateSteps(context, &DryRunBuildMetadataClient{}, io.Discard)
+		if test.err == "" {
+			if err != nil {
+				t.Errorf("%q: generateSteps returned err: %s", test.message, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%q: expected error %q, got %v", test.message, test.err, err)
+		}
+	}
 }
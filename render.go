@@ -0,0 +1,181 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// renderOptions are the render flags that aren't written directly to the
+// context.
+type renderOptions struct {
+	commitTime   string
+	buildTime    string
+	changedPaths string
+	useGit       bool
+	trailers     keyValueFlags
+	metadata     keyValueFlags
+}
+
+// keyValueFlags collects repeated key=value flags.
+type keyValueFlags map[string]string
+
+func (f keyValueFlags) String() string {
+	pairs := make([]string, 0, len(f))
+	for key, value := range f {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (f keyValueFlags) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("%q is not in the form key=value", value)
+	}
+	f[parts[0]] = parts[1]
+	return nil
+}
+
+// renderFlags defines the flags that describe a build on the given flag
+// set, writing them to the given context.
+func renderFlags(flags *flag.FlagSet, context *Context) *renderOptions {
+	options := &renderOptions{
+		trailers: keyValueFlags{},
+		metadata: keyValueFlags{},
+	}
+	flags.StringVar(&context.BranchName, "branch", "master", "the branch being built")
+	flags.StringVar(&context.BuildMessage, "message", "", "the build message")
+	flags.Uint64Var(&context.BuildNumber, "build-number", 1, "the build number")
+	flags.StringVar(&context.SourceGitCommitId, "commit", "0000000000000000000000000000000000000000", "the id of the commit being built")
+	flags.StringVar(&options.commitTime, "commit-time", "", "the time of the commit being built, in RFC 3339 format (default now)")
+	flags.StringVar(&options.buildTime, "build-time", "", "the time the build started, in RFC 3339 format (default now)")
+	flags.StringVar(&context.TagName, "tag", "", "the tag being built, if any")
+	flags.StringVar(&context.PullRequestNumber, "pull-request", "", "the number of the pull request being built, if any")
+	flags.StringVar(&context.PullRequestBaseBranch, "pull-request-base-branch", "master", "the branch the pull request would merge into")
+	flags.StringVar(&context.DefaultBranch, "default-branch", "", "the pipeline's default branch, which changes are found relative to (default master)")
+	flags.StringVar(&context.RepoURL, "repo", "", "the repository URL, from which the codebase name is taken")
+	flags.StringVar(&context.BuildkiteOrganizationSlug, "organization", "", "the Buildkite organization slug")
+	flags.StringVar(&context.BuildkitePipelineSlug, "pipeline", "", "the Buildkite pipeline slug")
+	flags.StringVar(&options.changedPaths, "changed-paths", "", "comma-separated files changed by the build, for phases and services limited to paths (default everything, or the changes found by -git)")
+	flags.Var(options.trailers, "trailer", "a trailer on the commit being built, like Jobsworth-Skip=validation_test (repeatable)")
+	flags.Var(options.metadata, "metadata", "build metadata the build was triggered with, like jobsworth:skip=validation_test (repeatable)")
+	flags.BoolVar(&options.useGit, "git", false, "take the commit details from the git repository in the current directory")
+	return options
+}
+
+// newRenderContext returns a context with the settings that the render
+// flags don't cover.
+func newRenderContext() *Context {
+	return &Context{
+		BuildEnvironment:        "render",
+		BuildkiteAPIAccessToken: "dry-run-default",
+		BuildTime:               time.Now(),
+	}
+}
+
+// renderCommand implements "jobsworth render <pipeline-file>", which
+// prints the steps that would be generated for a build described entirely
+// by its flags, without needing a Buildkite job or a git repository. It
+// returns the exit status.
+func renderCommand(args []string) int {
+	context := newRenderContext()
+	flags := flag.NewFlagSet("render", flag.ExitOnError)
+	options := renderFlags(flags, context)
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "Usage: jobsworth render [options] <pipeline-file>\n\n")
+		flags.PrintDefaults()
+		return 1
+	}
+	context.ConfigFilename = flags.Arg(0)
+
+	setFlags := map[string]bool{}
+	flags.Visit(func(f *flag.Flag) {
+		setFlags[f.Name] = true
+	})
+
+	if err := finishRenderContext(context, options, setFlags); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+
+	if err := run(context, true); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 2
+	}
+	return 0
+}
+
+// finishRenderContext fills in the parts of the context that are derived
+// from the render flags, rather than set directly by them. Flags that were
+// given explicitly take precedence over the details read from git.
+func finishRenderContext(context *Context, options *renderOptions, setFlags map[string]bool) error {
+	commitId := context.SourceGitCommitId
+	if options.useGit {
+		gitCommit, err := getCurrentGitCommit()
+		if err != nil {
+			return fmt.Errorf("Error reading current git commit: %s", err)
+		}
+		context.SetGitCommit(gitCommit)
+		if setFlags["commit"] {
+			context.SourceGitCommitId = commitId
+			// The changes made by some other commit can't be found.
+			context.InGitRepository = false
+		}
+	} else {
+		context.SourceGitCommitTime = time.Now().UTC()
+		context.CommitTrailers = map[string]string{}
+	}
+	for key, value := range options.trailers {
+		context.CommitTrailers[key] = value
+	}
+	context.BuildMetadata = options.metadata
+
+	if options.commitTime != "" {
+		t, err := time.Parse(time.RFC3339, options.commitTime)
+		if err != nil {
+			return fmt.Errorf("invalid -commit-time: %s", err)
+		}
+		context.SourceGitCommitTime = t.UTC()
+	}
+	if options.buildTime != "" {
+		t, err := time.Parse(time.RFC3339, options.buildTime)
+		if err != nil {
+			return fmt.Errorf("invalid -build-time: %s", err)
+		}
+		context.BuildTime = t
+	}
+
+	if setFlags["changed-paths"] {
+		context.ChangedPathsKnown = true
+		context.ChangedPaths = nil
+		for _, changedPath := range strings.Split(options.changedPaths, ",") {
+			if changedPath = strings.TrimSpace(changedPath); changedPath != "" {
+				context.ChangedPaths = append(context.ChangedPaths, changedPath)
+			}
+		}
+	}
+
+	if context.PullRequestNumber != "" {
+		context.InPullRequest = true
+	} else {
+		context.PullRequestBaseBranch = ""
+	}
+
+	var err error
+	context.CodeVersion, err = context.FormatCodeVersion(defaultCodeVersionFormat)
+	if err != nil {
+		return err
+	}
+
+	// The build message can trigger the same special behaviors as it
+	// would in a real build.
+	context.DoMessageMagic()
+	return nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFinishRenderContext(t *testing.T) {
+	context := &Context{
+		BranchName:            "master",
+		BuildMessage:          "Deploy #12 to FOO",
+		BuildNumber:           123,
+		SourceGitCommitId:     "eb3733d0a0f7d6b4d4b7b2c1c8e0c2b8f1e9a7c3",
+		PullRequestBaseBranch: "master",
+	}
+	err := finishRenderContext(context, &renderOptions{commitTime: "2017-08-12T16:00:11Z"}, map[string]bool{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := time.Date(2017, 8, 12, 16, 0, 11, 0, time.UTC); !context.SourceGitCommitTime.Equal(want) {
+		t.Errorf("SourceGitCommitTime is %s", context.SourceGitCommitTime)
+	}
+	if want := "2017-08-12-160011-eb3733d-000123"; context.CodeVersion != want {
+		t.Errorf("CodeVersion is %q, want %q", context.CodeVersion, want)
+	}
+	if context.InPullRequest || context.PullRequestBaseBranch != "" {
+		t.Errorf("non-PR render has pull request details %v %q", context.InPullRequest, context.PullRequestBaseBranch)
+	}
+	if context.ArtifactsFromBuildNumber != "12" || len(context.OverrideDeployEnvironmentNames) != 1 ||
+		context.OverrideDeployEnvironmentNames[0] != "FOO" {
+		t.Errorf(
+			"message magic not applied: artifacts %q, override %q",
+			context.ArtifactsFromBuildNumber, context.OverrideDeployEnvironmentNames,
+		)
+	}
+
+	context = &Context{PullRequestNumber: "42", PullRequestBaseBranch: "develop"}
+	if err := finishRenderContext(context, &renderOptions{}, map[string]bool{}); err != nil {
+		t.Fatal(err)
+	}
+	if !context.InPullRequest || context.PullRequestBaseBranch != "develop" {
+		t.Errorf("PR render has pull request details %v %q", context.InPullRequest, context.PullRequestBaseBranch)
+	}
+
+	err = finishRenderContext(&Context{}, &renderOptions{commitTime: "yesterday"}, map[string]bool{})
+	if err == nil {
+		t.Errorf("invalid commit time accepted")
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Service is one of several codebases built from the same repository. Its
+// configuration is merged over the rest of the pipeline file, in the same
+// way as an included file, so it can declare its own phases and
+// environments while sharing everything else.
+type Service struct {
+	// Path is the directory in the repository that holds the service.
+	Path string `yaml:"path"`
+
+	// Codebase is used for ${codebase} in the service's steps, in place
+	// of the name inferred from the repository URL. It defaults to the
+	// service's name.
+	Codebase string `yaml:"codebase"`
+
+	// Paths limits the service to builds that change a file matching one
+	// of its globs.
+	Paths []string `yaml:"paths"`
+
+	Pipeline `yaml:",inline"`
+
+	name string
+}
+
+// loadServices replaces each of the pipeline's services with the result
+// of merging its configuration over the rest of the pipeline, given as
+// generic YAML.
+func (p *Pipeline) loadServices(raw map[interface{}]interface{}) error {
+	rawServices, _ := raw["services"].(map[interface{}]interface{})
+	if len(rawServices) == 0 {
+		return nil
+	}
+
+	base := map[interface{}]interface{}{}
+	for k, v := range raw {
+		if k != "services" {
+			base[k] = v
+		}
+	}
+
+	for name, rawService := range rawServices {
+		nameStr := fmt.Sprint(name)
+		if serviceMap, ok := rawService.(map[interface{}]interface{}); ok && serviceMap["services"] != nil {
+			return fmt.Errorf("service %s cannot have services of its own", nameStr)
+		}
+		configBytes, err := yaml.Marshal(mergeYAML(base, rawService))
+		if err != nil {
+			return err
+		}
+		service := &Service{name: nameStr}
+		if err := yaml.Unmarshal(configBytes, service); err != nil {
+			return fmt.Errorf("service %s: %s", nameStr, err)
+		}
+		if service.Codebase == "" {
+			service.Codebase = nameStr
+		}
+		p.Services[nameStr] = service
+	}
+	return nil
+}
+
+// serviceNames returns the names of the pipeline's services in the order
+// that they are lowered.
+func (p *Pipeline) serviceNames() []string {
+	names := make([]string, 0, len(p.Services))
+	for name := range p.Services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// context returns a copy of the context for lowering the service's steps.
+func (s *Service) context(context *Context) *Context {
+	serviceContext := *context
+	serviceContext.ServiceName = s.name
+	serviceContext.ServicePath = s.Path
+	serviceContext.Codebase = s.Codebase
+	serviceContext.SkipDeployEnvironments = context.ServiceSkipDeployEnvironments[s.name]
+	return &serviceContext
+}
+
+// lowerServiceStages lowers each of the pipeline's services into its own
+// sequence of stages. A pipeline without services is lowered as a single
+// sequence.
+func (p *Pipeline) lowerServiceStages(context *Context) ([][]*loweredStage, error) {
+	if len(p.Services) == 0 {
+		stages, err := p.lowerStages(context)
+		if err != nil {
+			return nil, err
+		}
+		return [][]*loweredStage{stages}, nil
+	}
+
+	var serviceStages [][]*loweredStage
+	for _, name := range p.serviceNames() {
+		service := p.Services[name]
+		if !context.changedPathsMatch(service.Paths) {
+			continue
+		}
+		stages, err := service.Pipeline.lowerStages(service.context(context))
+		if err != nil {
+			return nil, fmt.Errorf("service %s: %s", name, err)
+		}
+		for _, stage := range stages {
+			for _, group := range stage.groups {
+				group.service = name
+			}
+		}
+		serviceStages = append(serviceStages, stages)
+	}
+	return serviceStages, nil
+}
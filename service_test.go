@@ -0,0 +1,184 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/go-test/deep"
+)
+
+func TestLoadServices(t *testing.T) {
+	pipeline, err := LoadPipelineFromFile("testdata/services.in.yaml")
+	if err != nil {
+		t.Fatal("LoadPipelineFromFile returned err:", err)
+	}
+	if diff := deep.Equal([]string{"api", "web"}, pipeline.serviceNames()); diff != nil {
+		t.Error(diff)
+	}
+
+	api := pipeline.Services["api"]
+	if api.Codebase != "api" || api.Path != "services/api" {
+		t.Errorf("unexpected api service: codebase %q, path %q", api.Codebase, api.Path)
+	}
+	if api.Phases["migrate"] == nil || len(api.Deploy) != 1 {
+		t.Error("the api service should have its own phase and the shared deploy steps")
+	}
+
+	web := pipeline.Services["web"]
+	if web.Codebase != "website" {
+		t.Errorf("expected the web service's codebase to be website, not %q", web.Codebase)
+	}
+	prod := web.Environments["prod"]
+	if prod == nil || !prod.Cautious || len(prod.After) != 1 {
+		t.Error("the web service's prod environment should be merged with the shared one", prod)
+	}
+	if pipeline.Environments["prod"].Cautious {
+		t.Error("a service's configuration should not change the shared pipeline")
+	}
+}
+
+func TestServicesDependsOn(t *testing.T) {
+	pipeline, err := LoadPipelineFromFile("testdata/services.in.yaml")
+	if err != nil {
+		t.Fatal("LoadPipelineFromFile returned err:", err)
+	}
+	pipeline.UseDependsOn = true
+
+	context := &Context{
+		ConfigFilename:        "testdata/services.in.yaml",
+		BuildkitePipelineSlug: "myrepo",
+		BranchName:            "master",
+	}
+	bkSteps, err := pipeline.Lower(context)
+	if err != nil {
+		t.Fatal("Lower returned err:", err)
+	}
+
+	dependsOn := map[string]interface{}{}
+	for _, bkStep := range bkSteps {
+		step := bkStep.(Step)
+		dependsOn[step["key"].(string)] = step["depends_on"]
+	}
+	// Each service starts without waiting for the others.
+	if dependsOn["api-build-1"] != nil || dependsOn["web-build-1"] != nil {
+		t.Error("services should not depend on each other", dependsOn)
+	}
+	if diff := deep.Equal([]interface{}{"web-deploy-qa-1"}, dependsOn["web-deploy-prod-1"]); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestServicesDeployHistory(t *testing.T) {
+	pipeline, err := LoadPipelineFromFile("testdata/services.in.yaml")
+	if err != nil {
+		t.Fatal("LoadPipelineFromFile returned err:", err)
+	}
+	for _, service := range pipeline.Services {
+		service.RecordDeployHistory = true
+	}
+	context := &Context{
+		BranchName:        "master",
+		SourceGitCommitId: "abc123",
+	}
+
+	// Only web is already running this commit in qa, so api still
+	// deploys there.
+	buildkite := &testBuildMetadataClient{
+		lastDeploys: map[string]*DeployRecord{
+			"jobsworth:deployed:web:qa": {Service: "web", BuildNumber: 10, CodeVersion: "v10", SourceCommitId: "abc123"},
+			"jobsworth:deployed:api:qa": {Service: "api", BuildNumber: 9, CodeVersion: "v9", SourceCommitId: "def456"},
+		},
+	}
+	if err := findAlreadyDeployed(context, pipeline, buildkite, io.Discard); err != nil {
+		t.Fatal("findAlreadyDeployed returned err:", err)
+	}
+	if context.SkipDeployEnvironments != nil {
+		t.Error("skips should be kept by service", context.SkipDeployEnvironments)
+	}
+	bkSteps, err := pipeline.Lower(context)
+	if err != nil {
+		t.Fatal("Lower returned err:", err)
+	}
+
+	var deploys, records []string
+	for _, bkStep := range bkSteps {
+		step, ok := bkStep.(Step)
+		if !ok || step["command"] == nil {
+			continue
+		}
+		command := step["command"].(string)
+		env := step["env"].(map[interface{}]interface{})
+		if strings.Contains(command, " deploy ENV=") {
+			deploys = append(deploys, command)
+		}
+		if strings.HasPrefix(command, "buildkite-agent meta-data set") {
+			records = append(records, command)
+			if !strings.Contains(env["JOBSWORTH_DEPLOY_RECORD"].(string), `"service":"`+env["JOBSWORTH_SERVICE"].(string)+`"`) {
+				t.Error("deploy record should name the service", env["JOBSWORTH_DEPLOY_RECORD"])
+			}
+		}
+	}
+	expected := []string{
+		"make -C api deploy ENV=qa",
+		"make -C api deploy ENV=prod",
+		"make -C website deploy ENV=prod",
+	}
+	if diff := deep.Equal(expected, deploys); diff != nil {
+		t.Error(diff)
+	}
+	for _, record := range records {
+		if !strings.Contains(record, `"jobsworth:deployed:api:$$JOBSWORTH_ENVIRONMENT"`) &&
+			!strings.Contains(record, `"jobsworth:deployed:web:$$JOBSWORTH_ENVIRONMENT"`) {
+			t.Error("deploy record key should include the service", record)
+		}
+	}
+	if len(records) != 3 {
+		t.Errorf("expected a deploy record for each deploy, got %v", records)
+	}
+}
+
+func TestServicesOverrideEnvironments(t *testing.T) {
+	tests := []struct {
+		message string
+		deploys []string
+	}{
+		// Only web declares preview, or allows sandboxes.
+		{"Deploy to preview", []string{"make -C website deploy ENV=preview"}},
+		{"Deploy to sandbox-1", []string{"make -C website deploy ENV=sandbox-1"}},
+		{
+			"Deploy to qa and preview",
+			[]string{
+				"make -C api deploy ENV=qa",
+				"make -C website deploy ENV=qa",
+				"make -C website deploy ENV=preview",
+			},
+		},
+		// A forced deploy goes to every service.
+		{
+			"Force deploy to preview",
+			[]string{"make -C api deploy ENV=preview", "make -C website deploy ENV=preview"},
+		},
+	}
+	for _, test := range tests {
+		context := &Context{
+			ConfigFilename: "testdata/services_adhoc.in.yaml",
+			BranchName:     "master",
+			BuildMessage:   test.message,
+		}
+		context.DoMessageMagic()
+		bkSteps, _, err := generateSteps(context, &DryRunBuildMetadataClient{}, io.Discard)
+		if err != nil {
+			t.Fatalf("%q: generateSteps returned err: %s", test.message, err)
+		}
+		var deploys []string
+		for _, bkStep := range bkSteps {
+			if step, ok := bkStep.(Step); ok && strings.Contains(step["command"].(string), " deploy ENV=") {
+				deploys = append(deploys, step["command"].(string))
+			}
+		}
+		if diff := deep.Equal(test.deploys, deploys); diff != nil {
+			t.Errorf("%q: %s", test.message, diff)
+		}
+	}
+}
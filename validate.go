@@ -0,0 +1,617 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/hil"
+	hilAST "github.com/hashicorp/hil/ast"
+	"gopkg.in/yaml.v2"
+)
+
+// ValidationProblem is a single problem found in a pipeline file. Line is
+// zero when the problem can't be attributed to a particular line.
+type ValidationProblem struct {
+	Filename string
+	Line     int
+	Message  string
+}
+
+func (p ValidationProblem) String() string {
+	if p.Line == 0 {
+		return fmt.Sprintf("%s: %s", p.Filename, p.Message)
+	}
+	return fmt.Sprintf("%s:%d: %s", p.Filename, p.Line, p.Message)
+}
+
+// The keys allowed in each type of Buildkite step, by the key that
+// identifies the type.
+var stepSchema = map[string][]string{
+	"command": {
+		"command", "commands", "label", "name", "key", "identifier", "id",
+		"agents", "env", "plugins", "artifact_paths", "branches", "if",
+		"depends_on", "allow_dependency_failure", "concurrency",
+		"concurrency_group", "concurrency_method", "parallelism", "retry",
+		"skip", "soft_fail", "timeout_in_minutes", "priority",
+		"cancel_on_build_failing", "matrix", "notify",
+	},
+	"wait": {
+		"wait", "key", "if", "depends_on", "allow_dependency_failure",
+		"continue_on_failure", "branches",
+	},
+	"block": {
+		"block", "label", "name", "key", "prompt", "fields", "branches", "if",
+		"depends_on", "allow_dependency_failure", "blocked_state",
+		"allowed_teams",
+	},
+	"input": {
+		"input", "label", "name", "key", "prompt", "fields", "branches", "if",
+		"depends_on", "allow_dependency_failure", "allowed_teams",
+	},
+	"trigger": {
+		"trigger", "label", "name", "key", "build", "async", "branches", "if",
+		"depends_on", "allow_dependency_failure", "skip", "soft_fail",
+	},
+	"group": {
+		"group", "label", "name", "key", "steps", "depends_on", "if",
+		"allow_dependency_failure", "notify",
+	},
+}
+
+// Descriptions of the pipeline file's structures for error messages.
+var validateStructNames = map[string]string{
+	"main.Pipeline":           "at the top level",
+	"main.Environment":        "in environment",
+	"main.Phase":              "in phase",
+	"main.BranchRule":         "in branch rule",
+	"main.TagRule":            "in tag rule",
+	"main.PullRequestRule":    "in pull_request",
+	"main.PreviewEnvironment": "in preview_environment",
+	"main.Approval":           "in approval",
+	"main.FreezeWindow":       "in freeze window",
+	"main.Service":            "in service",
+}
+
+var validateStructTypes = map[string]reflect.Type{
+	"main.Pipeline":           reflect.TypeOf(Pipeline{}),
+	"main.Environment":        reflect.TypeOf(Environment{}),
+	"main.Phase":              reflect.TypeOf(Phase{}),
+	"main.BranchRule":         reflect.TypeOf(BranchRule{}),
+	"main.TagRule":            reflect.TypeOf(TagRule{}),
+	"main.PullRequestRule":    reflect.TypeOf(PullRequestRule{}),
+	"main.PreviewEnvironment": reflect.TypeOf(PreviewEnvironment{}),
+	"main.Approval":           reflect.TypeOf(Approval{}),
+	"main.FreezeWindow":       reflect.TypeOf(FreezeWindow{}),
+	"main.Service":            reflect.TypeOf(Service{}),
+}
+
+var yamlUnknownFieldRegexp = regexp.MustCompile(`^line (\d+): field (\S+) not found in struct (\S+)$`)
+var yamlLineRegexp = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+
+// builtinVariables are the interpolation variables available to every step.
+var builtinVariables = []string{
+	"environment", "branch", "tag", "codebase", "code_version",
+	"source_git_commit", "cautious", "pull_request", "pull_request_number",
+	"pull_request_base_branch",
+}
+
+// ValidatePipelineFile strictly parses a pipeline file and checks its
+// steps and interpolations, returning any problems found.
+func ValidatePipelineFile(fn string) ([]ValidationProblem, error) {
+	v, pipeline, err := parsePipelineFileStrict(fn)
+	if err != nil {
+		return nil, err
+	}
+	if pipeline == nil {
+		return v.problems, nil
+	}
+
+	// Included files are checked for unknown keys on their own, so that
+	// their problems are reported against the file they're in, while the
+	// remaining checks apply to the pipeline with its includes merged.
+	var includeProblems []ValidationProblem
+	if len(pipeline.Include) > 0 || len(pipeline.Services) > 0 {
+		abs, _ := filepath.Abs(fn)
+		includeProblems = validateIncludedFiles(fn, pipeline.Include, map[string]bool{abs: true})
+		merged, err := LoadPipelineFromFile(fn)
+		if err != nil {
+			line := v.findKeyLine("include", 0)
+			if line == 0 {
+				line = v.findKeyLine("services", 0)
+			}
+			v.add(line, "%s", err)
+			v.sortProblems()
+			return append(v.problems, includeProblems...), nil
+		}
+		pipeline = merged
+	}
+
+	v.validatePipeline(pipeline)
+
+	v.sortProblems()
+	return append(v.problems, includeProblems...), nil
+}
+
+// parsePipelineFileStrict parses a single pipeline file, without merging
+// its includes, returning a validator holding any problems with its
+// structure. The pipeline is nil if the file isn't valid YAML.
+func parsePipelineFileStrict(fn string) (*validator, *Pipeline, error) {
+	configBytes, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, nil, err
+	}
+	v := &validator{
+		filename: fn,
+		lines:    strings.Split(string(configBytes), "\n"),
+	}
+
+	pipeline := &Pipeline{}
+	err = yaml.UnmarshalStrict(configBytes, pipeline)
+	if typeErr, ok := err.(*yaml.TypeError); ok {
+		for _, msg := range typeErr.Errors {
+			v.addYAMLError(msg)
+		}
+	} else if err != nil {
+		v.addYAMLError(err.Error())
+		return v, nil, nil
+	}
+	return v, pipeline, nil
+}
+
+// validateIncludedFiles checks the structure of the files included by fn,
+// and the files they include in turn. Files that can't be read, and
+// cycles, are left to be reported when the includes are merged.
+func validateIncludedFiles(fn string, includes []string, seen map[string]bool) []ValidationProblem {
+	var problems []ValidationProblem
+	for _, include := range includes {
+		includeFn := include
+		if !filepath.IsAbs(includeFn) {
+			includeFn = filepath.Join(filepath.Dir(fn), includeFn)
+		}
+		abs, _ := filepath.Abs(includeFn)
+		if seen[abs] {
+			continue
+		}
+		seen[abs] = true
+
+		v, pipeline, err := parsePipelineFileStrict(includeFn)
+		if err != nil {
+			continue
+		}
+		v.sortProblems()
+		problems = append(problems, v.problems...)
+		if pipeline != nil {
+			problems = append(problems, validateIncludedFiles(includeFn, pipeline.Include, seen)...)
+		}
+	}
+	return problems
+}
+
+type validator struct {
+	filename string
+	lines    []string
+	problems []ValidationProblem
+
+	// from is the line that searches from the start of the file begin
+	// at before looking at the whole file, so that a service's keys are
+	// found in its own section.
+	from int
+}
+
+func (v *validator) add(line int, format string, args ...interface{}) {
+	v.problems = append(v.problems, ValidationProblem{
+		Filename: v.filename,
+		Line:     line,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+func (v *validator) sortProblems() {
+	sort.SliceStable(v.problems, func(i, j int) bool {
+		return v.problems[i].Line < v.problems[j].Line
+	})
+}
+
+func (v *validator) addYAMLError(msg string) {
+	if match := yamlUnknownFieldRegexp.FindStringSubmatch(msg); match != nil {
+		// The yaml package reports the line of the enclosing mapping,
+		// so we look for the key itself from there.
+		line, _ := strconv.Atoi(match[1])
+		if keyLine := v.findKeyLine(match[2], line); keyLine != 0 {
+			line = keyLine
+		}
+		message := fmt.Sprintf("unknown key %q %s", match[2], validateStructNames[match[3]])
+		if suggestion := suggestKey(match[2], validateStructTypes[match[3]]); suggestion != "" {
+			message += fmt.Sprintf(" (did you mean %q?)", suggestion)
+		}
+		v.add(line, "%s", message)
+		return
+	}
+	if match := yamlLineRegexp.FindStringSubmatch(msg); match != nil {
+		line, _ := strconv.Atoi(match[1])
+		v.add(line, "%s", match[2])
+		return
+	}
+	v.add(0, "%s", msg)
+}
+
+// findLine returns the first line number from the given line onwards that
+// matches the expression, or zero if there isn't one.
+func (v *validator) findLine(re *regexp.Regexp, from int) int {
+	if from < 1 && v.from > 0 {
+		if line := v.findLine(re, v.from); line != 0 {
+			return line
+		}
+	}
+	if from < 1 {
+		from = 1
+	}
+	for i := from - 1; i < len(v.lines); i++ {
+		if re.MatchString(v.lines[i]) {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+func (v *validator) findKeyLine(key string, from int) int {
+	re := regexp.MustCompile(`^\s*(-\s+)?` + regexp.QuoteMeta(key) + `\s*:`)
+	return v.findLine(re, from)
+}
+
+func (v *validator) validatePipeline(pipeline *Pipeline) {
+	if len(pipeline.Services) > 0 {
+		v.validateServices(pipeline)
+		return
+	}
+
+	globalPhases, envPhases, err := pipeline.orderedPhases()
+	if err != nil {
+		v.add(v.findKeyLine("phases", 0), "%s", err)
+		return
+	}
+
+	envs, envNames, err := pipeline.environmentGraph()
+	if err == nil {
+		_, err = environmentLevels(envs, envNames)
+	}
+	if err != nil {
+		v.add(v.findKeyLine("environments", 0), "%s", err)
+	}
+
+	for _, rule := range pipeline.Branches {
+		if rule == nil {
+			continue
+		}
+		if _, err := matchPattern(rule.Pattern, ""); err != nil {
+			v.add(v.findKeyLine("branches", 0), "branch pattern %q: %s", rule.Pattern, err)
+		}
+	}
+	for _, rule := range pipeline.Tags {
+		if rule == nil {
+			continue
+		}
+		if _, err := matchPattern(rule.Pattern, ""); err != nil {
+			v.add(v.findKeyLine("tags", 0), "tag pattern %q: %s", rule.Pattern, err)
+		}
+	}
+
+	for _, pattern := range pipeline.AdhocEnvironments {
+		if _, err := matchPattern(pattern, ""); err != nil {
+			v.add(v.findKeyLine("adhoc_environments", 0), "adhoc environment pattern %q: %s", pattern, err)
+		}
+	}
+
+	if pipeline.CodeVersionFormat != "" {
+		if err := validateCodeVersionFormat(pipeline.CodeVersionFormat); err != nil {
+			v.add(v.findKeyLine("code_version_format", 0), "invalid code_version_format: %s", err)
+		}
+	}
+	if pipeline.Approval != nil {
+		if err := pipeline.Approval.validate(); err != nil {
+			v.add(v.findKeyLine("approval", 0), "invalid approval: %s", err)
+		}
+	}
+	for i, window := range pipeline.Freeze {
+		if window == nil {
+			continue
+		}
+		if err := window.validate(); err != nil {
+			v.add(v.findKeyLine("freeze", 0), "invalid freeze window %d: %s", i, err)
+		}
+	}
+	for _, phase := range append(append([]*Phase{}, globalPhases...), envPhases...) {
+		if err := validatePathGlobs(phase.Paths); err != nil {
+			line := v.findKeyLine("paths", v.findKeyLine(phase.name, 0))
+			v.add(line, "phase %s: %s", phase.name, err)
+		}
+	}
+
+	// Environment variables can only be used in per-environment phases,
+	// and only if every environment defines them.
+	var envConfigs []*Environment
+	for _, env := range envs {
+		envConfigs = append(envConfigs, env)
+	}
+	if pipeline.PullRequest != nil && pipeline.PullRequest.PreviewEnvironment != nil {
+		envConfigs = append(envConfigs, &pipeline.PullRequest.PreviewEnvironment.Environment)
+	}
+
+	// The pipeline's defaults apply to every phase, so they can only use
+	// the variables available to all of them.
+	defaultsLine := v.findLine(regexp.MustCompile(`^defaults\s*:`), 0)
+	v.validateDefaults(pipeline.Defaults, "defaults", defaultsLine, nil)
+
+	for _, phase := range globalPhases {
+		v.validateSteps(phase, nil)
+	}
+	for _, phase := range envPhases {
+		v.validateSteps(phase, envConfigs)
+	}
+}
+
+// validateServices validates each of the pipeline's services, which
+// include the rest of the pipeline. Problems in the parts that services
+// share are only reported once.
+func (v *validator) validateServices(pipeline *Pipeline) {
+	servicesLine := v.findKeyLine("services", 0)
+	seen := map[ValidationProblem]bool{}
+	for _, name := range pipeline.serviceNames() {
+		serviceValidator := &validator{
+			filename: v.filename,
+			lines:    v.lines,
+			from:     v.findKeyLine(name, servicesLine),
+		}
+		service := pipeline.Services[name]
+		if err := validatePathGlobs(service.Paths); err != nil {
+			serviceValidator.add(serviceValidator.findKeyLine("paths", 0), "service %s: %s", name, err)
+		}
+		serviceValidator.validatePipeline(&service.Pipeline)
+		for _, problem := range serviceValidator.problems {
+			if !seen[problem] {
+				seen[problem] = true
+				v.problems = append(v.problems, problem)
+			}
+		}
+	}
+}
+
+func (v *validator) validateSteps(phase *Phase, envConfigs []*Environment) {
+	// Steps can't be located precisely, so we assume that they appear in
+	// the file in order after the key that introduced them.
+	line := v.findKeyLine(phase.name, 0)
+	if len(phase.Defaults) > 0 {
+		where := fmt.Sprintf("%s defaults", phase.name)
+		v.validateDefaults(phase.Defaults, where, v.findKeyLine("defaults", line), envConfigs)
+	}
+	stepRegexp := regexp.MustCompile(`^\s*-\s`)
+	for i, step := range phase.Steps {
+		stepLine := v.findLine(stepRegexp, line+1)
+		if stepLine != 0 {
+			line = stepLine
+			if i == 0 {
+				// Later steps are at the same indentation as the first.
+				indent := v.lines[line-1][:strings.Index(v.lines[line-1], "-")]
+				stepRegexp = regexp.MustCompile(`^` + regexp.QuoteMeta(indent) + `-\s`)
+			}
+		}
+		where := fmt.Sprintf("%s step %d", phase.name, i)
+		v.validateStepSchema(step, where, line)
+		v.validateStepVariables(step, where, line, envConfigs)
+	}
+}
+
+// validateDefaults checks that step defaults only set keys that command
+// steps accept, and only use the variables that are defined wherever they
+// apply.
+func (v *validator) validateDefaults(defaults Step, where string, line int, envConfigs []*Environment) {
+	allowed := map[string]bool{}
+	for _, key := range stepSchema["command"] {
+		allowed[key] = true
+	}
+	var keys []string
+	for key := range defaults {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if !allowed[key] {
+			keyLine := v.findKeyLine(key, line)
+			if keyLine == 0 {
+				keyLine = line
+			}
+			v.add(keyLine, "%s: unknown key %q for a command step", where, key)
+		}
+	}
+	v.validateStepVariables(defaults, where, line, envConfigs)
+}
+
+func (v *validator) validateStepSchema(step Step, where string, line int) {
+	var stepTypes []string
+	for stepType := range stepSchema {
+		if _, ok := step[stepType]; ok {
+			stepTypes = append(stepTypes, stepType)
+		}
+	}
+	if _, ok := step["commands"]; ok {
+		if _, ok := step["command"]; !ok {
+			stepTypes = append(stepTypes, "command")
+		}
+	}
+	sort.Strings(stepTypes)
+
+	switch len(stepTypes) {
+	case 0:
+		v.add(line, "%s: not a command, wait, block, input, trigger or group step", where)
+		return
+	case 1:
+	default:
+		v.add(line, "%s: has more than one step type: %s", where, strings.Join(stepTypes, ", "))
+		return
+	}
+
+	allowed := map[string]bool{}
+	for _, key := range stepSchema[stepTypes[0]] {
+		allowed[key] = true
+	}
+	var keys []string
+	for key := range step {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if !allowed[key] {
+			keyLine := v.findKeyLine(key, line)
+			if keyLine == 0 {
+				keyLine = line
+			}
+			v.add(keyLine, "%s: unknown key %q for a %s step", where, key, stepTypes[0])
+		}
+	}
+}
+
+func (v *validator) validateStepVariables(step Step, where string, line int, envConfigs []*Environment) {
+	known := map[string]bool{}
+	for _, name := range builtinVariables {
+		known[name] = true
+	}
+
+	// Only the variables defined for every environment are known.
+	envVarCounts := map[string]int{}
+	for _, env := range envConfigs {
+		for name := range env.Variables {
+			envVarCounts["env."+name]++
+		}
+	}
+	for name, count := range envVarCounts {
+		if count == len(envConfigs) {
+			known[name] = true
+		}
+	}
+
+	err := hil.Walk(deepCopyStep(step), func(d *hil.WalkData) error {
+		d.Root.Accept(func(node hilAST.Node) hilAST.Node {
+			access, ok := node.(*hilAST.VariableAccess)
+			if !ok || known[access.Name] {
+				return node
+			}
+			re := regexp.MustCompile(`\$\{[^}]*` + regexp.QuoteMeta(access.Name))
+			varLine := v.findLine(re, line)
+			if varLine == 0 {
+				varLine = line
+			}
+			if strings.HasPrefix(access.Name, "env.") {
+				v.add(varLine, "%s: %s is not defined in the variables of every environment", where, access.Name)
+			} else {
+				v.add(varLine, "%s: unknown variable %s", where, access.Name)
+			}
+			return node
+		})
+		return nil
+	})
+	if err != nil {
+		v.add(line, "%s: %s", where, err)
+	}
+}
+
+// suggestKey finds the yaml key of the given struct type that is most
+// similar to an unknown key, if any is similar enough.
+func suggestKey(key string, structType reflect.Type) string {
+	best, _ := closestKey(key, structType)
+	return best
+}
+
+// closestKey returns the yaml key of the given struct type, including the
+// keys of its inline structs, that is most similar to the given key, along
+// with their edit distance. It returns "" if none are close.
+func closestKey(key string, structType reflect.Type) (string, int) {
+	best := ""
+	bestDistance := 4
+	if structType == nil {
+		return best, bestDistance
+	}
+	for i := 0; i < structType.NumField(); i++ {
+		field := structType.Field(i)
+		tag := strings.Split(field.Tag.Get("yaml"), ",")
+		if len(tag) > 1 && tag[1] == "inline" {
+			if suggestion, distance := closestKey(key, field.Type); distance < bestDistance {
+				best = suggestion
+				bestDistance = distance
+			}
+			continue
+		}
+		if tag[0] == "" {
+			continue
+		}
+		if distance := editDistance(key, tag[0]); distance < bestDistance {
+			best = tag[0]
+			bestDistance = distance
+		}
+	}
+	return best, bestDistance
+}
+
+// editDistance returns the Levenshtein distance between two strings.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = min3(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+// validateCommand implements "jobsworth validate <pipeline-file>",
+// returning the exit status.
+func validateCommand(args []string) int {
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "Usage: jobsworth validate <pipeline-file>\n\n")
+		return 1
+	}
+
+	problems, err := ValidatePipelineFile(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 2
+	}
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+	if len(problems) > 0 {
+		return 1
+	}
+	fmt.Printf("%s: OK\n", flags.Arg(0))
+	return 0
+}
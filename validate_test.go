@@ -0,0 +1,75 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/go-test/deep"
+)
+
+func TestValidatePipelineFile(t *testing.T) {
+	problems, err := ValidatePipelineFile("testdata/invalid.in.yaml")
+	if err != nil {
+		t.Fatal("ValidatePipelineFile returned err:", err)
+	}
+	actual := make([]string, len(problems))
+	for i, problem := range problems {
+		actual[i] = problem.String()
+	}
+	expected := []string{
+		`testdata/invalid.in.yaml:1: unknown key "smoketest" at the top level (did you mean "smoke_test"?)`,
+		`testdata/invalid.in.yaml:5: deploy step 0: env.region is not defined in the variables of every environment`,
+		`testdata/invalid.in.yaml:9: deploy step 1: unknown key "comand" for a wait step`,
+		`testdata/invalid.in.yaml:10: deploy step 2: unknown variable enviroment`,
+		`testdata/invalid.in.yaml:12: unknown key "cautious_deploy_enviroments" at the top level (did you mean "cautious_deploy_environments"?)`,
+		`testdata/invalid.in.yaml:21: unknown key "cautous" in environment (did you mean "cautious"?)`,
+		`testdata/invalid.in.yaml:24: defaults: unknown key "timeout_in_minute" for a command step`,
+	}
+	if diff := deep.Equal(expected, actual); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestValidatePipelineFileValid(t *testing.T) {
+	for _, fn := range []string{
+		"testdata/basic.in.yaml",
+		"testdata/environments.in.yaml",
+		"testdata/phases.in.yaml",
+		"testdata/branches.in.yaml",
+		"testdata/include.in.yaml",
+		"testdata/defaults.in.yaml",
+		"testdata/services.in.yaml",
+		"testdata/adhoc.in.yaml",
+		"testdata/services_adhoc.in.yaml",
+	} {
+		problems, err := ValidatePipelineFile(fn)
+		if err != nil {
+			t.Fatal("ValidatePipelineFile returned err:", err)
+		}
+		for _, problem := range problems {
+			t.Error("unexpected problem:", problem)
+		}
+	}
+}
+
+func TestSuggestKey(t *testing.T) {
+	tests := []struct {
+		key        string
+		structType reflect.Type
+		expected   string
+	}{
+		// The closest key is outside the service's inline pipeline, which
+		// has keys that are close too.
+		{"pathes", reflect.TypeOf(Service{}), "paths"},
+		{"codebases", reflect.TypeOf(Service{}), "codebase"},
+		// The closest key is in the inline pipeline.
+		{"smoketest", reflect.TypeOf(Service{}), "smoke_test"},
+		{"code_version_from_tags", reflect.TypeOf(TagRule{}), "code_version_from_tag"},
+		{"xyzzy", reflect.TypeOf(Service{}), ""},
+	}
+	for _, test := range tests {
+		if actual := suggestKey(test.key, test.structType); actual != test.expected {
+			t.Errorf("%q: got suggestion %q, want %q", test.key, actual, test.expected)
+		}
+	}
+}